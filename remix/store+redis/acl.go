@@ -0,0 +1,311 @@
+package store_redis
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "sort"
+    "strings"
+)
+
+const defaultUser = "default"
+
+var (
+    errNoAuth    = replyError("NOAUTH Authentication required.")
+    errWrongPass = replyError("WRONGPASS invalid username-password pair or user is disabled.")
+    errNoPermKey = replyError("NOPERM this user has no permissions to access one of the keys used as arguments")
+)
+
+// User is an account of the ACL model.
+type User struct {
+    Name      string
+    Passwords []string // any of them logs the user in
+    NoPass    bool     // any password logs the user in
+    // Commands the user may run: command names, "*" for all of them, and
+    // "-name" to take one away again.
+    Commands []string
+    // Keys holds glob patterns of the keys the user's commands may access.
+    Keys []string
+}
+
+// account is a User prepared for the checks done on every command.
+type account struct {
+    name      string
+    passwords [][sha256.Size]byte
+    nopass    bool
+    all       bool // every command but those denied
+    allow     map[string]bool
+    deny      map[string]bool
+    keys      [][]byte // nil for any key
+    patterns  []string
+}
+
+func newAccount(u *User) *account {
+    a := &account{
+        name:   u.Name,
+        nopass: u.NoPass,
+        allow:  make(map[string]bool),
+        deny:   make(map[string]bool),
+    }
+    for _, p := range u.Passwords {
+        a.passwords = append(a.passwords, sha256.Sum256([]byte(p)))
+    }
+    for _, name := range u.Commands {
+        name = strings.ToLower(name)
+        switch {
+        case name == "*":
+            a.all = true
+        case strings.HasPrefix(name, "-"):
+            a.deny[name[1:]] = true
+        default:
+            a.allow[name] = true
+        }
+    }
+    a.patterns = u.Keys
+    anyKey := false
+    for _, p := range u.Keys {
+        anyKey = anyKey || p == "*"
+        a.keys = append(a.keys, []byte(p))
+    }
+    if anyKey {
+        a.keys = nil
+    } else if a.keys == nil {
+        a.keys = [][]byte{}
+    }
+    return a
+}
+
+// newAccounts prepares the users of opts. Without users, a default user
+// may do anything.
+func newAccounts(opts []*Options) map[string]*account {
+    var users []*User
+    if len(opts) > 0 && opts[0] != nil {
+        users = opts[0].Users
+    }
+    if len(users) == 0 {
+        users = []*User{{Name: defaultUser, NoPass: true, Commands: []string{"*"}, Keys: []string{"*"}}}
+    }
+    accounts := make(map[string]*account, len(users))
+    for _, u := range users {
+        accounts[u.Name] = newAccount(u)
+    }
+    return accounts
+}
+
+// login checks password against every password of the account, so the
+// time it takes does not tell which one was close.
+func (a *account) login(password []byte) bool {
+    if a.nopass {
+        return true
+    }
+    sum := sha256.Sum256(password)
+    ok := 0
+    for i := range a.passwords {
+        ok |= subtle.ConstantTimeCompare(sum[:], a.passwords[i][:])
+    }
+    return ok == 1
+}
+func (a *account) canRun(name string) bool {
+    return (a.all || a.allow[name]) && !a.deny[name]
+}
+func (a *account) canAccess(key []byte) bool {
+    if a.keys == nil {
+        return true
+    }
+    for _, p := range a.keys {
+        if globMatch(p, key) {
+            return true
+        }
+    }
+    return false
+}
+
+// rules renders the account the way ACL LIST does.
+func (a *account) rules() string {
+    rules := []string{"user", a.name, "on"}
+    if a.nopass {
+        rules = append(rules, "nopass")
+    }
+    for _, p := range a.passwords {
+        rules = append(rules, "#"+hex.EncodeToString(p[:]))
+    }
+    if a.keys == nil {
+        rules = append(rules, "~*")
+    } else {
+        for _, p := range a.patterns {
+            rules = append(rules, "~"+p)
+        }
+    }
+    if a.all {
+        rules = append(rules, "+@all")
+    } else {
+        rules = append(rules, "-@all")
+        rules = append(rules, sortedNames("+", a.allow)...)
+    }
+    rules = append(rules, sortedNames("-", a.deny)...)
+    return strings.Join(rules, " ")
+}
+func sortedNames(sign string, names map[string]bool) []string {
+    var s []string
+    for name := range names {
+        s = append(s, sign+name)
+    }
+    sort.Strings(s)
+    return s
+}
+
+// authorize checks that the client may run cmd with args. Logging in and
+// out is always allowed.
+func (c *client) authorize(cmd *command, args [][]byte) error {
+    switch cmd.name {
+    case "auth", "hello", "quit":
+        return nil
+    }
+    if c.user == nil {
+        return errNoAuth
+    }
+    if !c.user.canRun(cmd.name) {
+        return replyError("NOPERM this user has no permissions to run the '" + cmd.name + "' command")
+    }
+    if c.user.keys == nil {
+        return nil
+    }
+    for _, key := range cmd.keys(args) {
+        if !c.user.canAccess(key) {
+            return errNoPermKey
+        }
+    }
+    return nil
+}
+
+// allowedKeys drops the keys the client may not see.
+func (c *client) allowedKeys(keys [][]byte) [][]byte {
+    if c.user.keys == nil {
+        return keys
+    }
+    allowed := keys[:0]
+    for _, key := range keys {
+        if c.user.canAccess(key) {
+            allowed = append(allowed, key)
+        }
+    }
+    return allowed
+}
+
+// auth logs the client in as user.
+func (c *client) auth(user, password []byte) error {
+    a := c.s.users[string(user)]
+    if a == nil || !a.login(password) {
+        return errWrongPass
+    }
+    c.user = a
+    return nil
+}
+
+// cmdAuth implements AUTH [username] password.
+func cmdAuth(c *client, args [][]byte) {
+    if len(args) > 3 {
+        writeError(c.conn, errSyntax)
+        return
+    }
+    user, password := []byte(defaultUser), args[1]
+    if len(args) == 3 {
+        user, password = args[1], args[2]
+    } else if a := c.s.users[defaultUser]; a != nil && a.nopass {
+        writeError(c.conn, replyError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+        return
+    }
+    if err := c.auth(user, password); err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    c.conn.WriteString("OK")
+}
+
+// cmdHello implements HELLO [protover [AUTH username password] [SETNAME
+// name]]. Only RESP2 is spoken.
+func cmdHello(c *client, args [][]byte) {
+    if len(args) > 1 {
+        if v, err := parseInt(args[1]); err != nil || v != 2 {
+            writeError(c.conn, replyError("NOPROTO unsupported protocol version"))
+            return
+        }
+    }
+    var name []byte
+    for i := 2; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "auth":
+            if i+2 >= len(args) {
+                writeError(c.conn, errSyntax)
+                return
+            }
+            if err := c.auth(args[i+1], args[i+2]); err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            i += 2
+        case "setname":
+            if i+1 >= len(args) {
+                writeError(c.conn, errSyntax)
+                return
+            }
+            name = args[i+1]
+            i++
+        default:
+            writeError(c.conn, errSyntax)
+            return
+        }
+    }
+    if c.user == nil {
+        writeError(c.conn, errNoAuth)
+        return
+    }
+    if name != nil {
+        c.name = string(name)
+    }
+    c.conn.WriteArray(14)
+    c.conn.WriteBulkString("server")
+    c.conn.WriteBulkString("redis")
+    c.conn.WriteBulkString("version")
+    c.conn.WriteBulkString(version)
+    c.conn.WriteBulkString("proto")
+    c.conn.WriteInt(2)
+    c.conn.WriteBulkString("id")
+    c.conn.WriteUint64(c.id)
+    c.conn.WriteBulkString("mode")
+    c.conn.WriteBulkString("standalone")
+    c.conn.WriteBulkString("role")
+    c.conn.WriteBulkString("master")
+    c.conn.WriteBulkString("modules")
+    c.conn.WriteArray(0)
+}
+
+// cmdACL implements ACL WHOAMI, ACL USERS and ACL LIST.
+func cmdACL(c *client, args [][]byte) {
+    sub := strings.ToLower(string(args[1]))
+    if len(args) != 2 {
+        writeError(c.conn, replyError("ERR unknown subcommand or wrong number of arguments for '"+sub+"'"))
+        return
+    }
+    names := make([]string, 0, len(c.s.users))
+    for name := range c.s.users {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    switch sub {
+    case "whoami":
+        c.conn.WriteBulkString(c.user.name)
+    case "users":
+        c.conn.WriteArray(len(names))
+        for _, name := range names {
+            c.conn.WriteBulkString(name)
+        }
+    case "list":
+        c.conn.WriteArray(len(names))
+        for _, name := range names {
+            c.conn.WriteBulkString(c.s.users[name].rules())
+        }
+    default:
+        writeError(c.conn, replyError("ERR unknown subcommand or wrong number of arguments for '"+sub+"'"))
+    }
+}
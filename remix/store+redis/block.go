@@ -0,0 +1,255 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/redcon"
+    "time"
+)
+
+// A client blocked by a command such as BLPOP or XREAD BLOCK is parked: its
+// connection is detached from redcon and served by c.serve from then on,
+// which waits for the keys to be written, for the timeout or for the client
+// to go away, whichever comes first.
+//
+// Blocked clients queue per key in the order they blocked. A write to the key
+// wakes every waiter that only reads, and the first waiter that consumes what
+// it finds; once served, that one passes the wakeup on to the next.
+
+type (
+    // waiter is a client blocked on keys.
+    waiter struct {
+        c       *client
+        keys    []blockKey
+        consume bool
+        timeout time.Duration // forever when 0
+        // retry serves the client from the keys, false when they still hold
+        // nothing for it
+        retry func() bool
+        woken chan struct{}
+    }
+    blockKey struct {
+        db  int
+        key string
+    }
+    readResult struct {
+        cmd redcon.Command
+        err error
+    }
+)
+
+// block parks c until retry serves it or timeout passes, replying with a
+// null array then. It reports false when c cannot block, inside EXEC.
+func (c *client) block(keys [][]byte, timeout time.Duration, consume bool, retry func() bool) bool {
+    if c.tx != nil {
+        return false
+    }
+    w := &waiter{c: c, consume: consume, timeout: timeout, retry: retry, woken: make(chan struct{}, 1)}
+    for _, key := range keys {
+        w.keys = append(w.keys, blockKey{db: c.db, key: string(key)})
+    }
+    s := c.s
+    s.blockMu.Lock()
+    for _, k := range w.keys {
+        s.blocked[k] = append(s.blocked[k], w)
+    }
+    s.blockMu.Unlock()
+    // retry once registered, not to miss a write since the first attempt
+    w.woken <- struct{}{}
+    c.waiting = w
+    return true
+}
+
+// unblock removes w from the queues of its keys. When it was served, the
+// next waiters are woken in case there is more for them, as they are when w
+// leaves with a wakeup it did not act on, not to lose it.
+func (s *server) unblock(w *waiter, served bool) {
+    s.blockMu.Lock()
+    defer s.blockMu.Unlock()
+    for _, k := range w.keys {
+        queue := s.blocked[k]
+        for i, o := range queue {
+            if o == w {
+                queue = append(queue[:i:i], queue[i+1:]...)
+                break
+            }
+        }
+        if len(queue) == 0 {
+            delete(s.blocked, k)
+        } else {
+            s.blocked[k] = queue
+        }
+    }
+    wake := served
+    if !served {
+        // no one wakes w once it left the queues
+        select {
+        case <-w.woken:
+            wake = true
+        default:
+        }
+    }
+    if wake {
+        for _, k := range w.keys {
+            s.wakeLocked(k)
+        }
+    }
+}
+
+// ready wakes the clients blocked on the keys of events, called once the
+// transaction that wrote them is committed.
+func (s *server) ready(events []keyEvent) {
+    if len(events) == 0 {
+        return
+    }
+    s.blockMu.Lock()
+    defer s.blockMu.Unlock()
+    if len(s.blocked) == 0 {
+        return
+    }
+    for _, ev := range events {
+        s.wakeLocked(blockKey{db: ev.db, key: string(ev.key)})
+    }
+}
+
+// readyDB wakes all the clients blocked on keys of database db.
+func (s *server) readyDB(db int) {
+    s.blockMu.Lock()
+    defer s.blockMu.Unlock()
+    for k := range s.blocked {
+        if k.db == db {
+            s.wakeLocked(k)
+        }
+    }
+}
+
+// wakeLocked wakes the waiters on k that read and the first that consumes.
+// It is called with s.blockMu held.
+func (s *server) wakeLocked(k blockKey) {
+    consumer := false
+    for _, w := range s.blocked[k] {
+        if w.consume {
+            if consumer {
+                continue
+            }
+            consumer = true
+        }
+        select {
+        case w.woken <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// blockedCount returns the number of blocked clients.
+func (s *server) blockedCount() int {
+    s.blockMu.Lock()
+    defer s.blockMu.Unlock()
+    seen := make(map[*waiter]bool)
+    for _, queue := range s.blocked {
+        for _, w := range queue {
+            seen[w] = true
+        }
+    }
+    return len(seen)
+}
+
+// serve runs the connection of c once detached to block it: it waits while
+// c is blocked, then reads and runs commands itself until the client goes
+// away or the connection is detached again for pub/sub.
+func (c *client) serve(dc redcon.DetachedConn) {
+    reads := make(chan readResult, 1)
+    reading := false
+    read := func() {
+        if !reading {
+            reading = true
+            go func() {
+                cmd, err := dc.ReadCommand()
+                reads <- readResult{cmd: cmd, err: err}
+            }()
+        }
+    }
+    var pending []redcon.Command
+    for {
+        if w := c.waiting; w != nil {
+            if err := dc.Flush(); err != nil {
+                c.s.unblock(w, false)
+                c.disconnect(dc)
+                return
+            }
+            var (
+                t       *time.Timer
+                timeout <-chan time.Time
+            )
+            if w.timeout > 0 {
+                t = time.NewTimer(w.timeout)
+                timeout = t.C
+            }
+            for c.waiting != nil {
+                // a pipelined command waits for the block to end, but a
+                // read still tells when the client disconnects
+                if len(pending) == 0 {
+                    read()
+                }
+                select {
+                case <-w.woken:
+                    if w.retry() {
+                        c.s.unblock(w, true)
+                        c.waiting = nil
+                    }
+                case <-timeout:
+                    c.s.unblock(w, false)
+                    c.waiting = nil
+                    c.conn.WriteArray(-1) // null array
+                case r := <-reads:
+                    reading = false
+                    if r.err != nil {
+                        c.s.unblock(w, false)
+                        c.disconnect(dc)
+                        return
+                    }
+                    pending = append(pending, r.cmd)
+                case <-c.s.done:
+                    c.s.unblock(w, false)
+                    c.disconnect(dc)
+                    return
+                }
+            }
+            if t != nil {
+                t.Stop()
+            }
+            c.track(c.info.cmd)
+        }
+        if c.detached {
+            c.s.forget(c)
+            return
+        }
+        var cmd redcon.Command
+        if len(pending) > 0 {
+            cmd, pending = pending[0], pending[1:]
+        } else {
+            if err := dc.Flush(); err != nil {
+                c.disconnect(dc)
+                return
+            }
+            read()
+            select {
+            case r := <-reads:
+                reading = false
+                if r.err != nil {
+                    c.disconnect(dc)
+                    return
+                }
+                cmd = r.cmd
+            case <-c.s.done:
+                c.disconnect(dc)
+                return
+            }
+        }
+        c.s.handle(dc, cmd)
+    }
+}
+
+// disconnect closes the detached connection of c and forgets the client.
+func (c *client) disconnect(dc redcon.DetachedConn) {
+    _ = dc.Close()
+    c.s.forget(c)
+}
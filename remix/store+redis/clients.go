@@ -0,0 +1,267 @@
+package store_redis
+
+import (
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// defaultMaxClients is the initial value of the maxclients setting.
+const defaultMaxClients = 10000
+
+// clientInfo is the state of a client shown to other connections, copied
+// by track around every command. Connections detached for pub/sub are no
+// longer tracked.
+type clientInfo struct {
+    name    string
+    db      int
+    user    string
+    multi   int // queued commands, -1 outside MULTI
+    blocked bool
+    cmd     string
+    last    time.Time
+}
+
+// track records the state of c after its command cmd.
+func (c *client) track(cmd string) {
+    info := clientInfo{name: c.name, db: c.db, multi: -1, cmd: cmd, last: time.Now()}
+    if c.user != nil {
+        info.user = c.user.name
+    }
+    if c.multi {
+        info.multi = len(c.queued)
+    }
+    info.blocked = c.waiting != nil
+    c.mu.Lock()
+    c.info = info
+    c.mu.Unlock()
+}
+
+// describe formats c as a line of CLIENT LIST.
+func (c *client) describe(now time.Time) string {
+    c.mu.Lock()
+    info := c.info
+    c.mu.Unlock()
+    flags := "N"
+    if info.multi >= 0 {
+        flags = "x"
+    }
+    if info.blocked {
+        flags = "b"
+    }
+    return "id=" + strconv.FormatUint(c.id, 10) +
+        " addr=" + c.addr +
+        " laddr=" + c.netConn.LocalAddr().String() +
+        " name=" + info.name +
+        " age=" + strconv.Itoa(int(now.Sub(c.created)/time.Second)) +
+        " idle=" + strconv.Itoa(int(now.Sub(info.last)/time.Second)) +
+        " flags=" + flags +
+        " db=" + strconv.Itoa(info.db) +
+        " multi=" + strconv.Itoa(info.multi) +
+        " cmd=" + info.cmd +
+        " user=" + info.user + "\n"
+}
+
+// kill closes the connection of c from any goroutine.
+func (c *client) kill() {
+    _ = c.netConn.Close()
+}
+
+func (s *server) clientCount() int {
+    s.clientsMu.Lock()
+    defer s.clientsMu.Unlock()
+    return len(s.clients)
+}
+
+// clientList returns the connected clients ordered by id.
+func (s *server) clientList() []*client {
+    s.clientsMu.Lock()
+    list := make([]*client, 0, len(s.clients))
+    for _, c := range s.clients {
+        list = append(list, c)
+    }
+    s.clientsMu.Unlock()
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].id < list[j].id
+    })
+    return list
+}
+
+// reapIdle disconnects the clients idle for longer than the timeout setting,
+// but for blocked ones, until the server stops.
+func (s *server) reapIdle() {
+    t := time.NewTicker(time.Second)
+    defer t.Stop()
+    for {
+        select {
+        case <-s.done:
+            return
+        case now := <-t.C:
+            timeout := time.Duration(atomic.LoadInt64(&s.timeout)) * time.Second
+            if timeout <= 0 {
+                continue
+            }
+            for _, c := range s.clientList() {
+                c.mu.Lock()
+                idle, blocked := now.Sub(c.info.last), c.info.blocked
+                c.mu.Unlock()
+                if idle > timeout && !blocked {
+                    c.kill()
+                }
+            }
+        }
+    }
+}
+
+// cmdClient implements CLIENT LIST [ID id ...], CLIENT INFO, CLIENT ID,
+// CLIENT SETNAME, CLIENT GETNAME and CLIENT KILL.
+func cmdClient(c *client, args [][]byte) {
+    sub := strings.ToLower(string(args[1]))
+    switch {
+    case sub == "list":
+        list := c.s.clientList()
+        if len(args) > 2 {
+            if len(args) == 3 || strings.ToLower(string(args[2])) != "id" {
+                writeError(c.conn, errSyntax)
+                return
+            }
+            ids := make(map[uint64]bool)
+            for _, arg := range args[3:] {
+                id, err := strconv.ParseUint(string(arg), 10, 64)
+                if err != nil {
+                    writeError(c.conn, replyError("ERR Invalid client ID"))
+                    return
+                }
+                ids[id] = true
+            }
+            filtered := list[:0]
+            for _, o := range list {
+                if ids[o.id] {
+                    filtered = append(filtered, o)
+                }
+            }
+            list = filtered
+        }
+        now := time.Now()
+        var b strings.Builder
+        for _, o := range list {
+            b.WriteString(o.describe(now))
+        }
+        c.conn.WriteBulkString(b.String())
+    case sub == "info" && len(args) == 2:
+        c.conn.WriteBulkString(c.describe(time.Now()))
+    case sub == "id" && len(args) == 2:
+        c.conn.WriteUint64(c.id)
+    case sub == "getname" && len(args) == 2:
+        if c.name == "" {
+            c.conn.WriteNull()
+        } else {
+            c.conn.WriteBulkString(c.name)
+        }
+    case sub == "setname" && len(args) == 3:
+        for _, b := range args[2] {
+            if b <= ' ' || b > '~' {
+                writeError(c.conn, replyError("ERR Client names cannot contain spaces, newlines or special characters."))
+                return
+            }
+        }
+        c.name = string(args[2])
+        c.conn.WriteString("OK")
+    case sub == "kill" && len(args) > 2:
+        clientKill(c, args[2:])
+    default:
+        writeError(c.conn, replyError("ERR unknown subcommand or wrong number of arguments for '"+sub+"'"))
+    }
+}
+
+// clientKill implements CLIENT KILL addr and CLIENT KILL with the ID, ADDR,
+// LADDR, USER and SKIPME filters.
+func clientKill(c *client, args [][]byte) {
+    var (
+        id                uint64
+        addr, laddr, user string
+        skipMe            = true
+    )
+    legacy := len(args) == 1
+    if legacy {
+        addr = string(args[0])
+    } else {
+        if len(args)%2 != 0 {
+            writeError(c.conn, errSyntax)
+            return
+        }
+        for i := 0; i < len(args); i += 2 {
+            value := string(args[i+1])
+            switch strings.ToLower(string(args[i])) {
+            case "id":
+                n, err := strconv.ParseUint(value, 10, 64)
+                if err != nil || n == 0 {
+                    writeError(c.conn, replyError("ERR client-id should be greater than 0"))
+                    return
+                }
+                id = n
+            case "addr":
+                addr = value
+            case "laddr":
+                laddr = value
+            case "user":
+                if c.s.users[value] == nil {
+                    writeError(c.conn, replyError("ERR No such user '"+value+"'"))
+                    return
+                }
+                user = value
+            case "skipme":
+                switch strings.ToLower(value) {
+                case "yes":
+                    skipMe = true
+                case "no":
+                    skipMe = false
+                default:
+                    writeError(c.conn, errSyntax)
+                    return
+                }
+            default:
+                writeError(c.conn, errSyntax)
+                return
+            }
+        }
+    }
+    var killed []*client
+    for _, o := range c.s.clientList() {
+        if o == c && skipMe && !legacy {
+            continue
+        }
+        if id != 0 && o.id != id || addr != "" && o.addr != addr {
+            continue
+        }
+        if laddr != "" && o.netConn.LocalAddr().String() != laddr {
+            continue
+        }
+        if user != "" {
+            o.mu.Lock()
+            name := o.info.user
+            o.mu.Unlock()
+            if name != user {
+                continue
+            }
+        }
+        killed = append(killed, o)
+    }
+    switch {
+    case !legacy:
+        c.conn.WriteInt(len(killed))
+    case len(killed) == 0:
+        writeError(c.conn, replyError("ERR No such client"))
+    default:
+        c.conn.WriteString("OK")
+    }
+    for _, o := range killed {
+        if o == c {
+            _ = c.conn.Close()
+        } else {
+            o.kill()
+        }
+    }
+}
@@ -0,0 +1,127 @@
+package store_redis
+
+import (
+    "errors"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// parameter is a setting of CONFIG GET and CONFIG SET, read-only when set
+// is nil.
+type parameter struct {
+    get func(s *server) string
+    set func(s *server, value string) error
+}
+
+var errNegative = errors.New("must not be negative")
+
+var parameters = map[string]*parameter{
+    "notify-keyspace-events": {
+        get: func(s *server) string {
+            return formatNotify(atomic.LoadUint32(&s.notify))
+        },
+        set: func(s *server, value string) error {
+            flags, err := parseNotify(value)
+            if err != nil {
+                return err
+            }
+            atomic.StoreUint32(&s.notify, flags)
+            return nil
+        },
+    },
+    "maxclients": {
+        get: func(s *server) string {
+            return strconv.FormatUint(uint64(atomic.LoadUint32(&s.maxClients)), 10)
+        },
+        set: func(s *server, value string) error {
+            n, err := strconv.ParseUint(value, 10, 32)
+            if err != nil {
+                return err
+            }
+            if n == 0 {
+                return errors.New("must be positive")
+            }
+            atomic.StoreUint32(&s.maxClients, uint32(n))
+            return nil
+        },
+    },
+    "timeout": {
+        get: func(s *server) string {
+            return strconv.FormatInt(atomic.LoadInt64(&s.timeout), 10)
+        },
+        set: func(s *server, value string) error {
+            n, err := strconv.ParseInt(value, 10, 64)
+            if err != nil {
+                return err
+            }
+            if n < 0 {
+                return errNegative
+            }
+            atomic.StoreInt64(&s.timeout, n)
+            return nil
+        },
+    },
+    "databases": {
+        get: func(s *server) string {
+            return strconv.Itoa(len(s.dbs))
+        },
+    },
+    // the store persists every write itself, without snapshots or a log
+    "save": {
+        get: func(s *server) string {
+            return ""
+        },
+    },
+    "appendonly": {
+        get: func(s *server) string {
+            return "no"
+        },
+    },
+}
+
+// cmdConfig implements CONFIG GET pattern, CONFIG SET parameter value and
+// CONFIG RESETSTAT.
+func cmdConfig(c *client, args [][]byte) {
+    sub := strings.ToLower(string(args[1]))
+    switch {
+    case sub == "get" && len(args) == 3:
+        pattern := []byte(strings.ToLower(string(args[2])))
+        var names []string
+        for name := range parameters {
+            if globMatch(pattern, []byte(name)) {
+                names = append(names, name)
+            }
+        }
+        sort.Strings(names)
+        c.conn.WriteArray(2 * len(names))
+        for _, name := range names {
+            c.conn.WriteBulkString(name)
+            c.conn.WriteBulkString(parameters[name].get(c.s))
+        }
+    case sub == "set" && len(args) == 4:
+        name := strings.ToLower(string(args[2]))
+        p := parameters[name]
+        if p == nil {
+            writeError(c.conn, replyError("ERR Unknown option or number of arguments for CONFIG SET - '"+name+"'"))
+            return
+        }
+        if p.set == nil {
+            writeError(c.conn, replyError("ERR CONFIG SET failed (possibly related to argument '"+name+"') - can't set immutable config"))
+            return
+        }
+        if err := p.set(c.s, string(args[3])); err != nil {
+            writeError(c.conn, replyError("ERR Invalid argument '"+string(args[3])+"' for CONFIG SET '"+name+"'"))
+            return
+        }
+        c.conn.WriteString("OK")
+    case sub == "resetstat" && len(args) == 2:
+        atomic.StoreUint64(&c.s.processed, 0)
+        atomic.StoreUint64(&c.s.connections, 0)
+        atomic.StoreUint64(&c.s.rejected, 0)
+        c.conn.WriteString("OK")
+    default:
+        writeError(c.conn, replyError("ERR unknown subcommand or wrong number of arguments for '"+sub+"'"))
+    }
+}
@@ -0,0 +1,99 @@
+package store_redis
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/DGHeroin/vault/store"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testConn talks RESP to a server started by serveTest.
+type testConn struct {
+    t *testing.T
+    c net.Conn
+    r *bufio.Reader
+}
+
+// serveTest serves a fresh store on a local port and returns its address.
+func serveTest(t *testing.T) string {
+    st, err := store.New(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go Serve(st, ln)
+    return ln.Addr().String()
+}
+func dialTest(t *testing.T, addr string) *testConn {
+    c, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        c.Close()
+    })
+    return &testConn{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+// do sends a command and returns its reply rendered as text: integers as
+// ":n", errors as "-msg", nil as "(nil)" and arrays as "[a b]".
+func (c *testConn) do(args ...string) string {
+    c.t.Helper()
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "*%d\r\n", len(args))
+    for _, a := range args {
+        fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+    }
+    if _, err := c.c.Write([]byte(sb.String())); err != nil {
+        c.t.Fatal(err)
+    }
+    return c.read()
+}
+func (c *testConn) read() string {
+    c.t.Helper()
+    _ = c.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    line = strings.TrimRight(line, "\r\n")
+    switch line[0] {
+    case '+':
+        return line[1:]
+    case '$':
+        n, _ := strconv.Atoi(line[1:])
+        if n < 0 {
+            return "(nil)"
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(c.r, buf); err != nil {
+            c.t.Fatal(err)
+        }
+        return string(buf[:n])
+    case '*':
+        n, _ := strconv.Atoi(line[1:])
+        if n < 0 {
+            return "(nil)"
+        }
+        parts := make([]string, n)
+        for i := range parts {
+            parts[i] = c.read()
+        }
+        return "[" + strings.Join(parts, " ") + "]"
+    }
+    return line
+}
+func (c *testConn) expect(want string, args ...string) {
+    c.t.Helper()
+    if got := c.do(args...); got != want {
+        c.t.Fatalf("%v: got %q, want %q", args, got, want)
+    }
+}
@@ -0,0 +1,340 @@
+package store_redis
+
+import (
+    "fmt"
+    "github.com/DGHeroin/vault/store"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Logical database 0 starts out as the root keyspace of the store with the
+// aux bucket "redis", database n as the buckets "redis.n" and "redis.n.aux".
+// SWAPDB exchanges which of those a logical number stands for; the exchange
+// is kept in the bucket "redis.dbs" as logical number -> physical number.
+
+const (
+    defaultDatabases = 16
+    dbsBucket        = "redis.dbs"
+)
+
+var errDBIndex = replyError("ERR DB index is out of range")
+
+// database is the storage of a logical redis database.
+type database struct {
+    // keys counts the keys stored, those expired but not yet reaped
+    // included, and expires those with a ttl, for INFO; first for atomic
+    // alignment
+    keys, expires int64
+
+    s    *store.Store
+    phys int
+    main *store.Bucket // nil for the root keyspace
+    aux  *store.Bucket
+
+    watchMu  sync.Mutex
+    watching map[*watchedKey]struct{} // from WATCH until EXEC or UNWATCH
+}
+
+func openDatabase(st *store.Store, phys int) (*database, error) {
+    d := &database{s: st, phys: phys}
+    var err error
+    if phys == 0 {
+        d.aux, err = st.Bucket(auxBucket)
+        return d, err
+    }
+    name := auxBucket + "." + strconv.Itoa(phys)
+    if d.main, err = st.Bucket(name); err != nil {
+        return nil, err
+    }
+    d.aux, err = st.Bucket(name + ".aux")
+    return d, err
+}
+
+// openDatabases opens n databases, ordered as the last SWAPDB left them. The
+// mapping outlives a change of n: a logical number the last SWAPDB mapped
+// past n keeps its physical database, and those of the numbers past n are
+// left for when n grows again.
+func openDatabases(st *store.Store, n int) ([]*database, *store.Bucket, error) {
+    mapping, err := st.Bucket(dbsBucket)
+    if err != nil {
+        return nil, nil, err
+    }
+    dbs := make([]*database, n)
+    used := make(map[int]int, n) // physical -> logical number
+    for i := range dbs {
+        phys := i
+        value, err := mapping.Get([]byte(strconv.Itoa(i)))
+        if err == nil {
+            phys, err = strconv.Atoi(string(value))
+        } else if err == store.ErrNotFound {
+            err = nil
+        }
+        if err != nil || phys < 0 {
+            return nil, nil, fmt.Errorf("redis: bad mapping of database %d in %q", i, dbsBucket)
+        }
+        if j, ok := used[phys]; ok {
+            return nil, nil, fmt.Errorf("redis: databases %d and %d both map to %d in %q", j, i, phys, dbsBucket)
+        }
+        used[phys] = i
+        if dbs[i], err = openDatabase(st, phys); err != nil {
+            return nil, nil, err
+        }
+        if err := dbs[i].count(); err != nil {
+            return nil, nil, err
+        }
+    }
+    return dbs, mapping, nil
+}
+
+func (d *database) keyspace(tx *store.Tx) *keyspace {
+    k := &keyspace{tx: tx, main: tx}
+    if d.main != nil {
+        k.main = tx.Bucket(d.main)
+    }
+    k.aux = &auxSpace{space: tx.Bucket(d.aux), k: k}
+    return k
+}
+
+// watch returns watchers of the writes to key and to its aux entries.
+func (d *database) watch(key []byte) (*store.Watcher, *store.Watcher) {
+    return d.watchMain(key), d.aux.Watch(pack(key))
+}
+
+// addWatched registers w for replaced, and dropWatched forgets it.
+func (d *database) addWatched(w *watchedKey) {
+    d.watchMu.Lock()
+    defer d.watchMu.Unlock()
+    if d.watching == nil {
+        d.watching = make(map[*watchedKey]struct{})
+    }
+    d.watching[w] = struct{}{}
+}
+func (d *database) dropWatched(w *watchedKey) {
+    d.watchMu.Lock()
+    defer d.watchMu.Unlock()
+    delete(d.watching, w)
+}
+
+// replaced marks the keys watched in d as changed, as SWAPDB and FLUSH*
+// change what d holds without the watchers seeing it.
+func (d *database) replaced() {
+    d.watchMu.Lock()
+    defer d.watchMu.Unlock()
+    for w := range d.watching {
+        atomic.StoreInt32(&w.replaced, 1)
+    }
+}
+func (d *database) watchMain(prefix []byte, opts ...*store.WatchOptions) *store.Watcher {
+    if d.main == nil {
+        return d.s.Watch(prefix, opts...)
+    }
+    return d.main.Watch(prefix, opts...)
+}
+func (d *database) flush() error {
+    var err error
+    if d.main == nil {
+        err = d.s.DeleteRange(nil, nil)
+    } else {
+        err = d.main.DeleteRange(nil, nil)
+    }
+    if err != nil {
+        return err
+    }
+    if err := d.aux.DeleteRange(nil, nil); err != nil {
+        return err
+    }
+    atomic.StoreInt64(&d.keys, 0)
+    atomic.StoreInt64(&d.expires, 0)
+    return nil
+}
+
+// count sets the key counts of d from a walk of its keys.
+func (d *database) count() error {
+    var keys, expires int64
+    err := d.s.View(func(tx *store.Tx) error {
+        k := d.keyspace(tx)
+        var err error
+        rangeErr := k.main.Range(nil, nil, func(key []byte, _ []byte) bool {
+            keys++
+            var ttl time.Duration
+            if ttl, err = k.main.TTL(key); err != nil {
+                return false
+            }
+            if ttl != store.NoTTL {
+                expires++
+            }
+            return true
+        }, keysOnly)
+        if rangeErr != nil {
+            return rangeErr
+        }
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    atomic.StoreInt64(&d.keys, keys)
+    atomic.StoreInt64(&d.expires, expires)
+    return nil
+}
+func (d *database) add(keys, expires int64) {
+    atomic.AddInt64(&d.keys, keys)
+    atomic.AddInt64(&d.expires, expires)
+}
+
+// dbNumber returns the logical number of d, -1 when it has none.
+func (s *server) dbNumber(d *database) int {
+    s.dbMu.RLock()
+    defer s.dbMu.RUnlock()
+    for i := range s.dbs {
+        if s.dbs[i] == d {
+            return i
+        }
+    }
+    return -1
+}
+
+// keyspace opens database number db in tx for writing; events collects its
+// notifications and counts the changes to its number of keys.
+func (s *server) keyspace(tx *store.Tx, db int, events *[]keyEvent, counts *[]keyCount) *keyspace {
+    k := s.dbs[db].keyspace(tx)
+    k.db, k.events, k.counts = db, events, counts
+    k.main = &countingSpace{mainSpace: k.main, k: k, d: s.dbs[db]}
+    return k
+}
+
+// parseDB parses the number of a database.
+func (s *server) parseDB(arg []byte) (int, error) {
+    n, err := strconv.Atoi(string(arg))
+    if err != nil {
+        return 0, replyError("ERR invalid DB index")
+    }
+    if n < 0 || n >= len(s.dbs) {
+        return 0, errDBIndex
+    }
+    return n, nil
+}
+
+func cmdSelect(c *client, args [][]byte) {
+    n, err := c.s.parseDB(args[1])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    c.db = n
+    c.conn.WriteString("OK")
+}
+func cmdSwapDB(c *client, args [][]byte) {
+    a, err := c.s.parseDB(args[1])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    b, err := c.s.parseDB(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    defer c.lockDBs(true)()
+    s := c.s
+    s.dbs[a], s.dbs[b] = s.dbs[b], s.dbs[a]
+    if c.tx != nil {
+        // EXEC puts the databases back if the transaction fails
+        m := c.tx.Bucket(s.dbMap)
+        if err = m.Put([]byte(strconv.Itoa(a)), []byte(strconv.Itoa(s.dbs[a].phys))); err == nil {
+            err = m.Put([]byte(strconv.Itoa(b)), []byte(strconv.Itoa(s.dbs[b].phys)))
+        }
+    } else {
+        err = s.dbMap.BatchPut(func(p store.Putter) {
+            p.Put([]byte(strconv.Itoa(a)), []byte(strconv.Itoa(s.dbs[a].phys)))
+            p.Put([]byte(strconv.Itoa(b)), []byte(strconv.Itoa(s.dbs[b].phys)))
+        })
+    }
+    if err != nil {
+        s.dbs[a], s.dbs[b] = s.dbs[b], s.dbs[a]
+        writeError(c.conn, err)
+        return
+    }
+    s.dbs[a].replaced()
+    s.dbs[b].replaced()
+    s.readyDB(a)
+    s.readyDB(b)
+    c.conn.WriteString("OK")
+}
+
+// cmdFlush implements FLUSHDB and FLUSHALL. Both take the optional ASYNC or
+// SYNC, and both run synchronously. Run by EXEC, they delete the keys in its
+// transaction.
+func cmdFlush(c *client, args [][]byte) {
+    if len(args) > 2 {
+        writeError(c.conn, errSyntax)
+        return
+    }
+    if len(args) == 2 {
+        switch strings.ToLower(string(args[1])) {
+        case "async", "sync":
+        default:
+            writeError(c.conn, errSyntax)
+            return
+        }
+    }
+    defer c.lockDBs(true)()
+    s := c.s
+    first, last := 0, len(s.dbs)
+    if strings.ToLower(string(args[0])) == "flushdb" {
+        first, last = c.db, c.db+1
+    }
+    for db := first; db < last; db++ {
+        s.dbs[db].replaced()
+        var err error
+        if c.tx != nil {
+            err = s.keyspace(c.tx, db, &c.events, &c.counts).clear()
+        } else {
+            err = s.dbs[db].flush()
+        }
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+    }
+    c.conn.WriteString("OK")
+}
+
+// cmdDBSize replies with the key count INFO reports too, which includes
+// the expired keys not yet reaped.
+func cmdDBSize(c *client, args [][]byte) {
+    defer c.lockDBs(false)()
+    c.conn.WriteInt64(atomic.LoadInt64(&c.s.dbs[c.db].keys))
+}
+func cmdMove(c *client, args [][]byte) {
+    n, err := c.s.parseDB(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    if n == c.db {
+        writeError(c.conn, replyError("ERR source and destination objects are the same"))
+        return
+    }
+    var ok bool
+    err = c.update(func(k *keyspace) error {
+        ok = false
+        to := c.s.keyspace(k.tx, n, k.events, k.counts)
+        if t, _, err := to.meta(args[1]); err != nil || t != typeNone {
+            return err
+        }
+        moved, err := k.copyKey(to, args[1], args[1])
+        if err != nil || !moved {
+            return err
+        }
+        ok = true
+        k.notify(notifyGeneric, "move_from", args[1])
+        to.notify(notifyGeneric, "move_to", args[1])
+        _, err = k.remove(args[1])
+        return err
+    })
+    writeBool(c, ok, err)
+}
@@ -0,0 +1,65 @@
+package store_redis
+
+import (
+    "testing"
+)
+
+func TestSwapAndFlushInvalidateWatch(t *testing.T) {
+    addr := serveTest(t)
+    a, b := dialTest(t, addr), dialTest(t, addr)
+    for _, replace := range [][]string{
+        {"swapdb", "0", "1"},
+        {"flushdb"},
+        {"flushall"},
+    } {
+        a.expect("OK", "set", "k", "v")
+        a.expect("OK", "watch", "k")
+        b.expect("OK", replace...)
+        a.expect("OK", "multi")
+        a.expect("QUEUED", "get", "k")
+        a.expect("(nil)", "exec")
+    }
+    // untouched, the watch holds
+    a.expect("OK", "watch", "k")
+    b.expect("OK", "swapdb", "2", "3")
+    a.expect("OK", "multi")
+    a.expect("QUEUED", "set", "k", "w")
+    a.expect("[OK]", "exec")
+}
+func TestSwapAndFlushInMulti(t *testing.T) {
+    c := dialTest(t, serveTest(t))
+    c.expect("OK", "set", "a", "1")
+    c.expect(":1", "hset", "h", "f", "v")
+    c.expect("OK", "multi")
+    c.expect("QUEUED", "set", "b", "2")
+    c.expect("QUEUED", "flushdb")
+    c.expect("QUEUED", "get", "a")
+    c.expect("QUEUED", "set", "c", "3")
+    c.expect("[OK OK (nil) OK]", "exec")
+    c.expect("[c]", "keys", "*")
+    c.expect("(nil)", "hget", "h", "f")
+    c.expect("OK", "multi")
+    c.expect("QUEUED", "swapdb", "0", "1")
+    c.expect("QUEUED", "get", "c")
+    c.expect("QUEUED", "info", "keyspace")
+    if got := c.do("exec"); got != "[OK (nil) # Keyspace\r\ndb1:keys=1,expires=0,avg_ttl=0\r\n]" {
+        t.Fatalf("exec: got %q", got)
+    }
+    c.expect("OK", "select", "1")
+    c.expect("3", "get", "c")
+    c.expect("OK", "multi")
+    c.expect("QUEUED", "flushall")
+    c.expect("[OK]", "exec")
+    c.expect("[]", "keys", "*")
+}
+func TestDBSize(t *testing.T) {
+    c := dialTest(t, serveTest(t))
+    c.expect(":0", "dbsize")
+    c.expect("OK", "mset", "a", "1", "b", "2")
+    c.expect(":1", "rpush", "l", "x")
+    c.expect(":3", "dbsize")
+    c.expect(":1", "del", "a")
+    c.expect(":2", "dbsize")
+    c.expect("OK", "select", "1")
+    c.expect(":0", "dbsize")
+}
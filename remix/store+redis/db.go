@@ -0,0 +1,449 @@
+package store_redis
+
+import (
+    "errors"
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+    "time"
+)
+
+// Every redis key has an entry in the main keyspace: the value itself for a
+// string, an empty value for the other types. Those keep their data in the
+// aux bucket under tuple keys:
+//
+//    (key)                       -> meta, a tuple starting with the type name
+//    (key, "h", field)           -> hash value
+//    (key, "l", index)           -> list element, meta holds the head and tail index
+//    (key, "s", member)          -> empty, set member
+//    (key, "z", member)          -> sorted set score
+//    (key, "Z", score, member)   -> empty, sorted set member ordered by score
+//    (key, "x", ms, seq)         -> stream entry, meta holds the length and last id
+//    (key, "g", group)           -> last stream id delivered to a consumer group
+//    (key, "c", group, consumer) -> time the consumer was last seen
+//    (key, "p", group, ms, seq)  -> entry pending in the group: consumer, delivery time and count
+//
+// Expiry is kept on the main entry only: the aux entries of an expired key
+// are deleted once the store reports it reaped, or when a key of that name is
+// created again, should the report be lost.
+
+const auxBucket = "redis"
+
+const (
+    typeNone   = "none"
+    typeString = "string"
+    typeHash   = "hash"
+    typeList   = "list"
+    typeSet    = "set"
+    typeZSet   = "zset"
+    typeStream = "stream"
+)
+
+var errCorrupt = errors.New("corrupt key metadata")
+
+// space is the part of store.Tx and store.TxBucket a keyspace works with.
+type space interface {
+    Get(key []byte) ([]byte, error)
+    Put(key, value []byte) error
+    Del(key []byte) error
+    Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*store.RangeOptions) error
+    RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*store.RangeOptions) error
+}
+
+// mainSpace also manages the expiry of keys.
+type mainSpace interface {
+    space
+    PutWithTTL(key, value []byte, ttl time.Duration) error
+    PutKeepTTL(key, value []byte) error
+    Expire(key []byte, ttl time.Duration) error
+    TTL(key []byte) (time.Duration, error)
+    Persist(key []byte) error
+    Expired(key []byte) (bool, error)
+}
+
+// keyspace is the redis database as seen by a transaction.
+type keyspace struct {
+    tx     *store.Tx
+    main   mainSpace
+    aux    space
+    db     int
+    events *[]keyEvent // nil when read-only
+    counts *[]keyCount // nil when read-only
+}
+
+// keyCount is a change to the number of keys of a database.
+type keyCount struct {
+    d             *database
+    keys, expires int64
+}
+
+// countingSpace counts the keys written through it, and their ttls, in
+// k.counts.
+type countingSpace struct {
+    mainSpace
+    k *keyspace
+    d *database
+}
+
+// auxSpace rewrites the main entry of a key along with its aux entries, so a
+// transaction that read the key conflicts with writes to its elements alone.
+type auxSpace struct {
+    space
+    k       *keyspace
+    touched map[string]struct{}
+}
+
+// meta returns the type of key and its meta, which is nil for strings.
+func (k *keyspace) meta(key []byte) (string, tuple.Tuple, error) {
+    if _, err := k.main.Get(key); err == store.ErrNotFound {
+        return typeNone, nil, nil
+    } else if err != nil {
+        return "", nil, err
+    }
+    data, err := k.aux.Get(pack(key))
+    if err == store.ErrNotFound {
+        return typeString, nil, nil
+    } else if err != nil {
+        return "", nil, err
+    }
+    meta, err := tuple.Unpack(data)
+    if err != nil || len(meta) == 0 {
+        return "", nil, errCorrupt
+    }
+    typ, ok := meta[0].(string)
+    if !ok {
+        return "", nil, errCorrupt
+    }
+    return typ, meta, nil
+}
+
+// lookup returns the meta of key, or nil when key does not exist. It fails
+// with errWrongType when key holds another type.
+func (k *keyspace) lookup(key []byte, typ string) (tuple.Tuple, error) {
+    t, meta, err := k.meta(key)
+    if err != nil || t == typeNone {
+        return nil, err
+    }
+    if t != typ {
+        return nil, errWrongType
+    }
+    return meta, nil
+}
+
+// create makes key a new key of the type of meta.
+func (k *keyspace) create(key []byte, meta tuple.Tuple) error {
+    if err := k.clearStale(key); err != nil {
+        return err
+    }
+    if err := k.main.Put(key, nil); err != nil {
+        return err
+    }
+    return k.setMeta(key, meta)
+}
+func (k *keyspace) setMeta(key []byte, meta tuple.Tuple) error {
+    return k.aux.Put(pack(key), pack(meta...))
+}
+
+// putString sets key to the string value, replacing a key of any type.
+func (k *keyspace) putString(key, value []byte) error {
+    t, _, err := k.meta(key)
+    if err != nil {
+        return err
+    }
+    if err := k.reuse(key, t); err != nil {
+        return err
+    }
+    return k.main.Put(key, value)
+}
+
+// reuse drops the aux entries of key, of type t, before it is overwritten
+// with a string.
+func (k *keyspace) reuse(key []byte, t string) error {
+    switch t {
+    case typeNone:
+        return k.clearStale(key)
+    case typeString:
+        return nil
+    }
+    return k.clearAux(key)
+}
+
+// remove deletes key whatever its type and reports whether it existed.
+func (k *keyspace) remove(key []byte) (bool, error) {
+    t, _, err := k.meta(key)
+    if err != nil {
+        return false, err
+    }
+    if err := k.reuse(key, t); err != nil || t == typeNone {
+        return false, err
+    }
+    return true, k.main.Del(key)
+}
+
+// copyKey makes dst of the keyspace to a copy of src, ttl included,
+// replacing whatever dst held. It reports false when src does not exist.
+func (k *keyspace) copyKey(to *keyspace, src, dst []byte) (bool, error) {
+    t, _, err := k.meta(src)
+    if err != nil || t == typeNone {
+        return false, err
+    }
+    value, err := k.main.Get(src)
+    if err != nil {
+        return false, err
+    }
+    ttl, err := k.main.TTL(src)
+    if err != nil {
+        return false, err
+    }
+    if _, err := to.remove(dst); err != nil {
+        return false, err
+    }
+    if t != typeString {
+        // every aux entry of src starts with pack(src)
+        from, prefix := pack(src), pack(dst)
+        start, limit, err := tuple.Range(tuple.Tuple{src})
+        if err != nil {
+            return false, err
+        }
+        keys, values := [][]byte{from}, [][]byte(nil)
+        err = k.aux.Range(start, limit, func(key []byte, value []byte) bool {
+            keys = append(keys, key)
+            values = append(values, value)
+            return true
+        })
+        if err != nil {
+            return false, err
+        }
+        meta, err := k.aux.Get(from)
+        if err != nil {
+            return false, err
+        }
+        values = append([][]byte{meta}, values...)
+        for i, key := range keys {
+            if err := to.aux.Put(append(append([]byte(nil), prefix...), key[len(from):]...), values[i]); err != nil {
+                return false, err
+            }
+        }
+    }
+    if ttl == store.NoTTL {
+        return true, to.main.Put(dst, value)
+    }
+    return true, to.main.PutWithTTL(dst, value, ttl)
+}
+
+// drop deletes a key that is not a string, once its last member is gone.
+func (k *keyspace) drop(key []byte) error {
+    if err := k.clearAux(key); err != nil {
+        return err
+    }
+    k.notify(notifyGeneric, "del", key)
+    return k.main.Del(key)
+}
+
+// clear deletes every key, and the aux entries expired keys left.
+func (k *keyspace) clear() error {
+    for _, space := range []space{k.main, k.aux} {
+        var keys [][]byte
+        err := space.Range(nil, nil, func(key []byte, _ []byte) bool {
+            keys = append(keys, key)
+            return true
+        }, keysOnly)
+        if err != nil {
+            return err
+        }
+        // the main keys go first, so deleting their aux entries rewrites
+        // nothing
+        for _, key := range keys {
+            if err := space.Del(key); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// clearStale deletes the aux entries left by an expired key.
+func (k *keyspace) clearStale(key []byte) error {
+    if _, err := k.aux.Get(pack(key)); err == store.ErrNotFound {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    return k.clearAux(key)
+}
+
+// clearAux deletes the meta and all aux entries of key.
+func (k *keyspace) clearAux(key []byte) error {
+    start, limit, err := tuple.Range(tuple.Tuple{key})
+    if err != nil {
+        return err
+    }
+    keys := [][]byte{pack(key)}
+    err = k.aux.Range(start, limit, func(key []byte, _ []byte) bool {
+        keys = append(keys, key)
+        return true
+    }, keysOnly)
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        if err := k.aux.Del(key); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// members walks the aux entries of key of the given kind, passing fn the
+// elements that follow the kind.
+func (k *keyspace) members(key []byte, kind string, fn func(elems tuple.Tuple, value []byte) bool, opts ...*store.RangeOptions) error {
+    start, limit, err := tuple.Range(tuple.Tuple{key, kind})
+    if err != nil {
+        return err
+    }
+    var perr error
+    err = k.aux.Range(start, limit, func(aux []byte, value []byte) bool {
+        t, err := tuple.Unpack(aux)
+        if err != nil || len(t) < 3 {
+            perr = errCorrupt
+            return false
+        }
+        return fn(t[2:], value)
+    }, opts...)
+    if err != nil {
+        return err
+    }
+    return perr
+}
+
+func (a *auxSpace) Put(key, value []byte) error {
+    if err := a.space.Put(key, value); err != nil {
+        return err
+    }
+    return a.touch(key)
+}
+func (a *auxSpace) Del(key []byte) error {
+    if err := a.space.Del(key); err != nil {
+        return err
+    }
+    return a.touch(key)
+}
+
+// touch rewrites the main entry of the key aux belongs to, unless aux is its
+// meta, which the readers of the key read anyway, or the key is gone.
+func (a *auxSpace) touch(aux []byte) error {
+    t, err := tuple.Unpack(aux)
+    if err != nil || len(t) < 2 {
+        return nil
+    }
+    key, ok := t[0].([]byte)
+    if !ok {
+        return nil
+    }
+    if _, ok := a.touched[string(key)]; ok {
+        return nil
+    }
+    if _, err := a.k.main.Get(key); err == store.ErrNotFound {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    // a key being cleared has lost its meta first
+    if _, err := a.space.Get(pack(key)); err == store.ErrNotFound {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    if a.touched == nil {
+        a.touched = make(map[string]struct{})
+    }
+    a.touched[string(key)] = struct{}{}
+    return a.k.main.PutKeepTTL(key, nil)
+}
+
+func (m *countingSpace) Put(key, value []byte) error {
+    return m.count(key, func() error {
+        return m.mainSpace.Put(key, value)
+    })
+}
+func (m *countingSpace) Del(key []byte) error {
+    return m.count(key, func() error {
+        return m.mainSpace.Del(key)
+    })
+}
+func (m *countingSpace) PutWithTTL(key, value []byte, ttl time.Duration) error {
+    return m.count(key, func() error {
+        return m.mainSpace.PutWithTTL(key, value, ttl)
+    })
+}
+func (m *countingSpace) PutKeepTTL(key, value []byte) error {
+    return m.count(key, func() error {
+        return m.mainSpace.PutKeepTTL(key, value)
+    })
+}
+func (m *countingSpace) Expire(key []byte, ttl time.Duration) error {
+    return m.count(key, func() error {
+        return m.mainSpace.Expire(key, ttl)
+    })
+}
+func (m *countingSpace) Persist(key []byte) error {
+    return m.count(key, func() error {
+        return m.mainSpace.Persist(key)
+    })
+}
+
+// count runs write, counting how it changes whether key is stored and has a
+// ttl.
+func (m *countingSpace) count(key []byte, write func() error) error {
+    keys, expires, err := m.state(key)
+    if err != nil {
+        return err
+    }
+    if err := write(); err != nil {
+        return err
+    }
+    keysAfter, expiresAfter, err := m.state(key)
+    if err != nil {
+        return err
+    }
+    if keys != keysAfter || expires != expiresAfter {
+        *m.k.counts = append(*m.k.counts, keyCount{d: m.d, keys: keysAfter - keys, expires: expiresAfter - expires})
+    }
+    return nil
+}
+
+// state returns 1 for keys when key is stored, 1 for expires when it also has
+// a ttl. An expired key is stored until the store reaps it.
+func (m *countingSpace) state(key []byte) (keys, expires int64, err error) {
+    ttl, err := m.mainSpace.TTL(key)
+    switch {
+    case err == nil && ttl == store.NoTTL:
+        return 1, 0, nil
+    case err == nil:
+        return 1, 1, nil
+    case err != store.ErrNotFound:
+        return 0, 0, err
+    }
+    if expired, err := m.mainSpace.Expired(key); err != nil || !expired {
+        return 0, 0, err
+    }
+    return 1, 1, nil
+}
+
+// pack encodes a tuple of elements known to be supported.
+func pack(elems ...interface{}) []byte {
+    data, err := tuple.Pack(elems)
+    if err != nil {
+        panic(err)
+    }
+    return data
+}
+
+// count returns the integer element i of meta.
+func count(meta tuple.Tuple, i int) int64 {
+    if len(meta) > i {
+        if n, ok := meta[i].(int64); ok {
+            return n
+        }
+    }
+    return 0
+}
@@ -0,0 +1,118 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "strings"
+    "time"
+)
+
+// cmdExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT with their
+// NX, XX, GT and LT options.
+func cmdExpire(c *client, args [][]byte) {
+    name := strings.ToLower(string(args[0]))
+    n, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    unit := time.Second
+    if name[0] == 'p' {
+        unit = time.Millisecond
+    }
+    ttl, ok := expireIn(n, unit, strings.HasSuffix(name, "at"))
+    if !ok {
+        writeError(c.conn, replyError("ERR invalid expire time in '"+name+"' command"))
+        return
+    }
+    var nx, xx, gt, lt bool
+    for _, arg := range args[3:] {
+        switch strings.ToLower(string(arg)) {
+        case "nx":
+            nx = true
+        case "xx":
+            xx = true
+        case "gt":
+            gt = true
+        case "lt":
+            lt = true
+        default:
+            writeError(c.conn, replyError("ERR Unsupported option "+string(arg)))
+            return
+        }
+    }
+    if (nx && (xx || gt || lt)) || (gt && lt) {
+        writeError(c.conn, replyError("ERR NX and XX, GT or LT options at the same time are not compatible"))
+        return
+    }
+    var set bool
+    err = c.update(func(k *keyspace) error {
+        set = false
+        t, _, err := k.meta(args[1])
+        if err != nil || t == typeNone {
+            return err
+        }
+        cur, err := k.main.TTL(args[1])
+        if err != nil {
+            return err
+        }
+        // a key without ttl counts as one that never expires
+        persistent := cur == store.NoTTL
+        if (nx && !persistent) || (xx && persistent) || (gt && (persistent || ttl <= cur)) || (lt && !persistent && ttl >= cur) {
+            return nil
+        }
+        set = true
+        if ttl <= 0 {
+            k.notify(notifyGeneric, "del", args[1])
+            _, err := k.remove(args[1])
+            return err
+        }
+        k.notify(notifyGeneric, "expire", args[1])
+        return k.main.Expire(args[1], ttl)
+    })
+    writeBool(c, set, err)
+}
+
+// cmdTTL also serves PTTL.
+func cmdTTL(c *client, args [][]byte) {
+    var ttl time.Duration
+    err := c.view(func(k *keyspace) error {
+        t, _, err := k.meta(args[1])
+        if err != nil || t == typeNone {
+            ttl = -2
+            return err
+        }
+        if ttl, err = k.main.TTL(args[1]); err == store.ErrNotFound {
+            ttl, err = -2, nil
+        }
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case ttl < 0:
+        // -1 when the key has no ttl, -2 when it does not exist
+        c.conn.WriteInt64(int64(ttl))
+    case strings.ToLower(string(args[0])) == "pttl":
+        c.conn.WriteInt64(int64((ttl + time.Millisecond/2) / time.Millisecond))
+    default:
+        c.conn.WriteInt64(int64((ttl + time.Second/2) / time.Second))
+    }
+}
+func cmdPersist(c *client, args [][]byte) {
+    var ok bool
+    err := c.update(func(k *keyspace) error {
+        ok = false
+        t, _, err := k.meta(args[1])
+        if err != nil || t == typeNone {
+            return err
+        }
+        cur, err := k.main.TTL(args[1])
+        if err != nil || cur == store.NoTTL {
+            return err
+        }
+        ok = true
+        k.notify(notifyGeneric, "persist", args[1])
+        return k.main.Persist(args[1])
+    })
+    writeBool(c, ok, err)
+}
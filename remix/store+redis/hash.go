@@ -0,0 +1,271 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// open returns the meta of key, creating key with meta fresh when it does not
+// exist yet. The type is the first element of fresh.
+func (k *keyspace) open(key []byte, fresh tuple.Tuple) (tuple.Tuple, error) {
+    meta, err := k.lookup(key, fresh[0].(string))
+    if err != nil || meta != nil {
+        return meta, err
+    }
+    return fresh, k.create(key, fresh)
+}
+
+// hset sets field and reports whether it is new.
+func (k *keyspace) hset(key, field, value []byte) (bool, error) {
+    aux := pack(key, "h", field)
+    _, err := k.aux.Get(aux)
+    if err != nil && err != store.ErrNotFound {
+        return false, err
+    }
+    return err == store.ErrNotFound, k.aux.Put(aux, value)
+}
+
+func cmdHSet(c *client, args [][]byte) {
+    if len(args)%2 != 0 {
+        writeArgError(c.conn, args[0])
+        return
+    }
+    var added int64
+    err := c.update(func(k *keyspace) error {
+        added = 0
+        meta, err := k.open(args[1], tuple.Tuple{typeHash, int64(0)})
+        if err != nil {
+            return err
+        }
+        for i := 2; i < len(args); i += 2 {
+            isNew, err := k.hset(args[1], args[i], args[i+1])
+            if err != nil {
+                return err
+            }
+            if isNew {
+                added++
+            }
+        }
+        k.notify(notifyHash, "hset", args[1])
+        return k.setMeta(args[1], tuple.Tuple{typeHash, count(meta, 1) + added})
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case strings.ToLower(string(args[0])) == "hmset":
+        c.conn.WriteString("OK")
+    default:
+        c.conn.WriteInt64(added)
+    }
+}
+func cmdHSetNX(c *client, args [][]byte) {
+    var ok bool
+    err := c.update(func(k *keyspace) error {
+        meta, err := k.open(args[1], tuple.Tuple{typeHash, int64(0)})
+        if err != nil {
+            return err
+        }
+        _, err = k.aux.Get(pack(args[1], "h", args[2]))
+        if ok = err == store.ErrNotFound; !ok {
+            return err
+        }
+        if err := k.aux.Put(pack(args[1], "h", args[2]), args[3]); err != nil {
+            return err
+        }
+        k.notify(notifyHash, "hset", args[1])
+        return k.setMeta(args[1], tuple.Tuple{typeHash, count(meta, 1) + 1})
+    })
+    writeBool(c, ok, err)
+}
+func cmdHGet(c *client, args [][]byte) {
+    var value []byte
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeHash)
+        if err != nil || meta == nil {
+            return err
+        }
+        value, err = k.aux.Get(pack(args[1], "h", args[2]))
+        if err == store.ErrNotFound {
+            return nil
+        }
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case value == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(value)
+    }
+}
+func cmdHMGet(c *client, args [][]byte) {
+    values := make([][]byte, len(args)-2)
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeHash)
+        if err != nil || meta == nil {
+            return err
+        }
+        for i, field := range args[2:] {
+            values[i], err = k.aux.Get(pack(args[1], "h", field))
+            if err != nil && err != store.ErrNotFound {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeBulks(c.conn, values)
+}
+
+// cmdHGetAll also serves HKEYS and HVALS.
+func cmdHGetAll(c *client, args [][]byte) {
+    name := strings.ToLower(string(args[0]))
+    var values [][]byte
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeHash)
+        if err != nil || meta == nil {
+            return err
+        }
+        return k.members(args[1], "h", func(elems tuple.Tuple, value []byte) bool {
+            field, _ := elems[0].([]byte)
+            switch name {
+            case "hkeys":
+                values = append(values, field)
+            case "hvals":
+                values = append(values, value)
+            default:
+                values = append(values, field, value)
+            }
+            return true
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeBulks(c.conn, values)
+}
+func cmdHDel(c *client, args [][]byte) {
+    var removed int64
+    err := c.update(func(k *keyspace) error {
+        removed = 0
+        meta, err := k.lookup(args[1], typeHash)
+        if err != nil || meta == nil {
+            return err
+        }
+        for _, field := range args[2:] {
+            aux := pack(args[1], "h", field)
+            if _, err := k.aux.Get(aux); err == store.ErrNotFound {
+                continue
+            } else if err != nil {
+                return err
+            }
+            if err := k.aux.Del(aux); err != nil {
+                return err
+            }
+            removed++
+        }
+        if removed > 0 {
+            k.notify(notifyHash, "hdel", args[1])
+        }
+        if n := count(meta, 1) - removed; n > 0 {
+            return k.setMeta(args[1], tuple.Tuple{typeHash, n})
+        }
+        return k.drop(args[1])
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(removed)
+    }
+}
+func cmdHLen(c *client, args [][]byte) {
+    writeCount(c, args[1], typeHash)
+}
+func cmdHExists(c *client, args [][]byte) {
+    var ok bool
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeHash)
+        if err != nil || meta == nil {
+            return err
+        }
+        _, err = k.aux.Get(pack(args[1], "h", args[2]))
+        if ok = err == nil; err == store.ErrNotFound {
+            return nil
+        }
+        return err
+    })
+    writeBool(c, ok, err)
+}
+func cmdHIncrBy(c *client, args [][]byte) {
+    delta, err := parseInt(args[3])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var n int64
+    err = c.update(func(k *keyspace) error {
+        meta, err := k.open(args[1], tuple.Tuple{typeHash, int64(0)})
+        if err != nil {
+            return err
+        }
+        aux := pack(args[1], "h", args[2])
+        n = 0
+        old, err := k.aux.Get(aux)
+        switch err {
+        case nil:
+            if n, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+                return replyError("ERR hash value is not an integer")
+            }
+        case store.ErrNotFound:
+            if err := k.setMeta(args[1], tuple.Tuple{typeHash, count(meta, 1) + 1}); err != nil {
+                return err
+            }
+        default:
+            return err
+        }
+        if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+            return errOverflow
+        }
+        n += delta
+        k.notify(notifyHash, "hincrby", args[1])
+        return k.aux.Put(aux, strconv.AppendInt(nil, n, 10))
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+
+// writeCount replies with the number of members of key, kept in its meta.
+func writeCount(c *client, key []byte, typ string) {
+    var n int64
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(key, typ)
+        n = count(meta, 1)
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+func writeBool(c *client, ok bool, err error) {
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case ok:
+        c.conn.WriteInt(1)
+    default:
+        c.conn.WriteInt(0)
+    }
+}
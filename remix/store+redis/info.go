@@ -0,0 +1,226 @@
+package store_redis
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// infoSections are the sections of INFO, in the order they are written.
+var infoSections = []struct {
+    name  string
+    write func(s *server, b *strings.Builder) error
+}{
+    {"server", infoServer},
+    {"clients", infoClients},
+    {"memory", infoMemory},
+    {"persistence", infoPersistence},
+    {"stats", infoStats},
+    {"storage", infoStorage},
+    {"keyspace", infoKeyspace},
+}
+
+// cmdInfo implements INFO [section ...]; all sections are written when
+// none, "default", "all" or "everything" is given.
+func cmdInfo(c *client, args [][]byte) {
+    want := make(map[string]bool)
+    for _, arg := range args[1:] {
+        switch name := strings.ToLower(string(arg)); name {
+        case "default", "all", "everything":
+        default:
+            want[name] = true
+        }
+    }
+    defer c.lockDBs(false)()
+    var b strings.Builder
+    for _, section := range infoSections {
+        if len(want) > 0 && !want[section.name] {
+            continue
+        }
+        if b.Len() > 0 {
+            b.WriteString("\r\n")
+        }
+        b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+        if err := section.write(c.s, &b); err != nil {
+            writeError(c.conn, err)
+            return
+        }
+    }
+    c.conn.WriteBulkString(b.String())
+}
+func infoField(b *strings.Builder, name string, value interface{}) {
+    fmt.Fprintf(b, "%s:%v\r\n", name, value)
+}
+func infoServer(s *server, b *strings.Builder) error {
+    uptime := time.Since(s.started)
+    infoField(b, "redis_version", version)
+    infoField(b, "redis_mode", "standalone")
+    infoField(b, "os", runtime.GOOS)
+    infoField(b, "arch_bits", strconv.IntSize)
+    infoField(b, "go_version", runtime.Version())
+    infoField(b, "process_id", os.Getpid())
+    infoField(b, "uptime_in_seconds", int64(uptime/time.Second))
+    infoField(b, "uptime_in_days", int64(uptime/(24*time.Hour)))
+    return nil
+}
+func infoClients(s *server, b *strings.Builder) error {
+    infoField(b, "connected_clients", s.clientCount())
+    infoField(b, "maxclients", atomic.LoadUint32(&s.maxClients))
+    infoField(b, "blocked_clients", s.blockedCount())
+    return nil
+}
+func infoMemory(s *server, b *strings.Builder) error {
+    var m runtime.MemStats
+    runtime.ReadMemStats(&m)
+    infoField(b, "used_memory", m.HeapAlloc)
+    infoField(b, "used_memory_human", humanBytes(int64(m.HeapAlloc)))
+    infoField(b, "used_memory_rss", m.Sys)
+    infoField(b, "used_memory_rss_human", humanBytes(int64(m.Sys)))
+    infoField(b, "gc_cycles", m.NumGC)
+    return nil
+}
+func infoPersistence(s *server, b *strings.Builder) error {
+    infoField(b, "loading", 0)
+    infoField(b, "rdb_bgsave_in_progress", 0)
+    infoField(b, "aof_enabled", 0)
+    return nil
+}
+func infoStats(s *server, b *strings.Builder) error {
+    infoField(b, "total_connections_received", atomic.LoadUint64(&s.connections))
+    infoField(b, "total_commands_processed", atomic.LoadUint64(&s.processed))
+    infoField(b, "rejected_connections", atomic.LoadUint64(&s.rejected))
+    return nil
+}
+
+// infoStorage reports on the store and its leveldb backend.
+func infoStorage(s *server, b *strings.Builder) error {
+    st, err := s.store.Stats()
+    if err != nil {
+        return err
+    }
+    infoField(b, "store_writes", st.Writes)
+    infoField(b, "store_transactions", st.Transactions)
+    infoField(b, "store_watchers", st.Watchers)
+    infoField(b, "disk_size", st.DiskSize)
+    infoField(b, "disk_size_human", humanBytes(st.DiskSize))
+    infoField(b, "store_memory", st.MemorySize)
+    infoField(b, "store_memory_human", humanBytes(st.MemorySize))
+    levels := make([]string, len(st.LevelSizes))
+    for i, size := range st.LevelSizes {
+        levels[i] = fmt.Sprintf("%d:tables=%d,size=%d", i, st.LevelTables[i], size)
+    }
+    infoField(b, "leveldb_levels", strings.Join(levels, ";"))
+    infoField(b, "leveldb_opened_tables", st.OpenedTables)
+    infoField(b, "leveldb_alive_snapshots", st.AliveSnapshots)
+    infoField(b, "leveldb_alive_iterators", st.AliveIterators)
+    infoField(b, "leveldb_io_read", st.IORead)
+    infoField(b, "leveldb_io_write", st.IOWrite)
+    infoField(b, "leveldb_write_delays", st.WriteDelays)
+    infoField(b, "leveldb_write_delay_ms", int64(st.WriteDelay/time.Millisecond))
+    if st.WritePaused {
+        infoField(b, "leveldb_write_paused", 1)
+    } else {
+        infoField(b, "leveldb_write_paused", 0)
+    }
+    return nil
+}
+
+// infoKeyspace reports the key counts of every database that is not empty.
+// It is called with s.dbMu held.
+func infoKeyspace(s *server, b *strings.Builder) error {
+    for i, d := range s.dbs {
+        if keys := atomic.LoadInt64(&d.keys); keys > 0 {
+            infoField(b, "db"+strconv.Itoa(i), fmt.Sprintf("keys=%d,expires=%d,avg_ttl=0", keys, atomic.LoadInt64(&d.expires)))
+        }
+    }
+    return nil
+}
+
+// humanBytes formats n like redis does for the *_human fields.
+func humanBytes(n int64) string {
+    const units = "KMGTPE"
+    if n < 1024 {
+        return strconv.FormatInt(n, 10) + "B"
+    }
+    v, i := float64(n)/1024, 0
+    for v >= 1024 && i < len(units)-1 {
+        v /= 1024
+        i++
+    }
+    return strconv.FormatFloat(v, 'f', 2, 64) + units[i:i+1]
+}
+
+// cmdCommand implements COMMAND, COMMAND COUNT, COMMAND INFO name ... and
+// COMMAND GETKEYS command arg ....
+func cmdCommand(c *client, args [][]byte) {
+    if len(args) == 1 {
+        names := make([]string, 0, len(commands))
+        for name := range commands {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        c.conn.WriteArray(len(names))
+        for _, name := range names {
+            writeCommand(c, commands[name])
+        }
+        return
+    }
+    sub := strings.ToLower(string(args[1]))
+    switch {
+    case sub == "count" && len(args) == 2:
+        c.conn.WriteInt(len(commands))
+    case sub == "info":
+        c.conn.WriteArray(len(args) - 2)
+        for _, name := range args[2:] {
+            if cmd := commands[strings.ToLower(string(name))]; cmd != nil {
+                writeCommand(c, cmd)
+            } else {
+                c.conn.WriteNull()
+            }
+        }
+    case sub == "getkeys" && len(args) > 2:
+        cmd := commands[strings.ToLower(string(args[2]))]
+        if cmd == nil {
+            writeError(c.conn, replyError("ERR Invalid command specified"))
+            return
+        }
+        line := args[2:]
+        if n := len(line); (cmd.arity > 0 && n != cmd.arity) || n < -cmd.arity {
+            writeError(c.conn, replyError("ERR Invalid number of arguments specified for command"))
+            return
+        }
+        keys := cmd.keys(line)
+        if len(keys) == 0 {
+            writeError(c.conn, replyError("ERR The command has no key arguments"))
+            return
+        }
+        writeBulks(c.conn, keys)
+    default:
+        writeError(c.conn, replyError("ERR unknown subcommand or wrong number of arguments for '"+sub+"'"))
+    }
+}
+
+// writeCommand replies with the name, arity, flags and key positions of cmd.
+// Flags are not tracked and left empty.
+func writeCommand(c *client, cmd *command) {
+    c.conn.WriteArray(6)
+    c.conn.WriteBulkString(cmd.name)
+    c.conn.WriteInt(cmd.arity)
+    c.conn.WriteArray(0)
+    c.conn.WriteInt(cmd.first)
+    c.conn.WriteInt(cmd.last)
+    c.conn.WriteInt(cmd.step)
+}
+
+// cmdTime replies with the unix time in seconds and microseconds.
+func cmdTime(c *client, args [][]byte) {
+    now := time.Now()
+    c.conn.WriteArray(2)
+    c.conn.WriteBulkString(strconv.FormatInt(now.Unix(), 10))
+    c.conn.WriteBulkString(strconv.Itoa(now.Nanosecond() / 1000))
+}
@@ -0,0 +1,314 @@
+package store_redis
+
+import (
+    "bytes"
+    "github.com/DGHeroin/redcon"
+    "github.com/DGHeroin/vault/store"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// cmdDel also serves UNLINK: the keys are gone once the batch is written.
+func cmdDel(c *client, args [][]byte) {
+    var n int
+    err := c.update(func(k *keyspace) error {
+        n = 0
+        for _, key := range args[1:] {
+            ok, err := k.remove(key)
+            if err != nil {
+                return err
+            }
+            if ok {
+                k.notify(notifyGeneric, "del", key)
+                n++
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt(n)
+    }
+}
+func cmdExists(c *client, args [][]byte) {
+    var n int
+    err := c.view(func(k *keyspace) error {
+        for _, key := range args[1:] {
+            t, _, err := k.meta(key)
+            if err != nil {
+                return err
+            }
+            if t != typeNone {
+                n++
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt(n)
+    }
+}
+
+// cmdRename also serves RENAMENX, which does nothing when the new key
+// exists.
+func cmdRename(c *client, args [][]byte) {
+    nx := strings.ToLower(string(args[0])) == "renamenx"
+    src, dst := args[1], args[2]
+    var ok bool
+    err := c.update(func(k *keyspace) error {
+        ok = false
+        t, _, err := k.meta(src)
+        if err != nil {
+            return err
+        }
+        if t == typeNone {
+            return replyError("ERR no such key")
+        }
+        if nx {
+            if t, _, err := k.meta(dst); err != nil || t != typeNone {
+                return err
+            }
+        }
+        if bytes.Equal(src, dst) {
+            ok = !nx
+            return nil
+        }
+        if _, err := k.copyKey(k, src, dst); err != nil {
+            return err
+        }
+        ok = true
+        k.notify(notifyGeneric, "rename_from", src)
+        k.notify(notifyGeneric, "rename_to", dst)
+        _, err = k.remove(src)
+        return err
+    })
+    if !nx && err == nil {
+        c.conn.WriteString("OK")
+        return
+    }
+    writeBool(c, ok, err)
+}
+
+// cmdCopy implements COPY source destination [DB n] [REPLACE].
+func cmdCopy(c *client, args [][]byte) {
+    db, replace := c.db, false
+    for i := 3; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "replace":
+            replace = true
+        case "db":
+            if i+1 == len(args) {
+                writeError(c.conn, errSyntax)
+                return
+            }
+            n, err := c.s.parseDB(args[i+1])
+            if err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            db = n
+            i++
+        default:
+            writeError(c.conn, errSyntax)
+            return
+        }
+    }
+    src, dst := args[1], args[2]
+    if db == c.db && bytes.Equal(src, dst) {
+        writeError(c.conn, replyError("ERR source and destination objects are the same"))
+        return
+    }
+    var ok bool
+    err := c.update(func(k *keyspace) (err error) {
+        ok = false
+        to := k
+        if db != c.db {
+            to = c.s.keyspace(k.tx, db, k.events, k.counts)
+        }
+        if !replace {
+            if t, _, err := to.meta(dst); err != nil || t != typeNone {
+                return err
+            }
+        }
+        if ok, err = k.copyKey(to, src, dst); ok {
+            to.notify(notifyGeneric, "copy_to", dst)
+        }
+        return err
+    })
+    writeBool(c, ok, err)
+}
+func cmdType(c *client, args [][]byte) {
+    var t string
+    err := c.view(func(k *keyspace) (err error) {
+        t, _, err = k.meta(args[1])
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteString(t)
+    }
+}
+func cmdKeys(c *client, args [][]byte) {
+    var keys [][]byte
+    err := c.view(func(k *keyspace) error {
+        keys = nil
+        return k.scanKeys(args[1], nil, func(key []byte, match bool) bool {
+            if match {
+                keys = append(keys, key)
+            }
+            return true
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        writeKeys(c.conn, c.allowedKeys(keys))
+    }
+}
+
+// cmdScan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+// A cursor stands for the last key examined, so keys written between calls
+// neither shift the walk nor make it return a key twice.
+func cmdScan(c *client, args [][]byte) {
+    id, err := strconv.ParseUint(string(args[1]), 10, 64)
+    if err != nil {
+        writeError(c.conn, errCursor)
+        return
+    }
+    var after []byte
+    if id != 0 {
+        var ok bool
+        if after, ok = c.s.cursors.get(c.db, id); !ok {
+            writeError(c.conn, errCursor)
+            return
+        }
+    }
+    pattern, count, typ := []byte("*"), int64(10), ""
+    for i := 2; i < len(args); i += 2 {
+        if i+1 == len(args) {
+            writeError(c.conn, errSyntax)
+            return
+        }
+        switch strings.ToLower(string(args[i])) {
+        case "match":
+            pattern = args[i+1]
+        case "count":
+            if count, err = parseInt(args[i+1]); err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            if count < 1 {
+                writeError(c.conn, errSyntax)
+                return
+            }
+        case "type":
+            typ = strings.ToLower(string(args[i+1]))
+        default:
+            writeError(c.conn, errSyntax)
+            return
+        }
+    }
+    var keys [][]byte
+    var last []byte
+    err = c.view(func(k *keyspace) error {
+        keys, last = nil, nil
+        n := int64(0)
+        err := k.scanKeys(pattern, after, func(key []byte, match bool) bool {
+            if match {
+                keys = append(keys, key)
+            }
+            if n++; n == count {
+                last = key
+                return false
+            }
+            return true
+        })
+        if err != nil || typ == "" {
+            return err
+        }
+        matched := keys[:0]
+        for _, key := range keys {
+            t, _, err := k.meta(key)
+            if err != nil {
+                return err
+            }
+            if t == typ {
+                matched = append(matched, key)
+            }
+        }
+        keys = matched
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    c.conn.WriteArray(2)
+    if last == nil {
+        c.conn.WriteBulkString("0")
+    } else {
+        c.conn.WriteBulkString(strconv.FormatUint(c.s.cursors.add(c.db, last), 10))
+    }
+    writeKeys(c.conn, c.allowedKeys(keys))
+}
+
+// scanKeys walks the keys after after, passing fn each key and whether it
+// matches the glob pattern. Only the keys under the literal prefix of
+// pattern are walked.
+func (k *keyspace) scanKeys(pattern, after []byte, fn func(key []byte, match bool) bool) error {
+    prefix, all := globPrefix(string(pattern))
+    return k.main.RangePrefix([]byte(prefix), func(key []byte, _ []byte) bool {
+        return fn(key, all || globMatch(pattern, key))
+    }, &store.RangeOptions{KeysOnly: true, After: after})
+}
+func writeKeys(conn redcon.Conn, keys [][]byte) {
+    conn.WriteArray(len(keys))
+    for _, key := range keys {
+        conn.WriteBulk(key)
+    }
+}
+
+var errCursor = replyError("ERR invalid cursor")
+
+// maxCursors bounds the SCAN cursors a server remembers; the oldest are
+// forgotten first.
+const maxCursors = 1 << 12
+
+// cursors maps the SCAN cursors handed out to the position they stand for,
+// which keeps cursors the decimal integers clients expect.
+type (
+    cursors struct {
+        mu        sync.Mutex
+        last      uint64
+        positions map[uint64]scanPosition
+    }
+    scanPosition struct {
+        db  int
+        key []byte // the last examined
+    }
+)
+
+func (cs *cursors) add(db int, key []byte) uint64 {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    if cs.positions == nil {
+        cs.positions = make(map[uint64]scanPosition)
+    }
+    cs.last++
+    cs.positions[cs.last] = scanPosition{db: db, key: key}
+    delete(cs.positions, cs.last-maxCursors)
+    return cs.last
+}
+
+// get returns the key cursor id of database db stands for.
+func (cs *cursors) get(db int, id uint64) ([]byte, bool) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    p, ok := cs.positions[id]
+    return p.key, ok && p.db == db
+}
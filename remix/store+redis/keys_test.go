@@ -0,0 +1,42 @@
+package store_redis
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestScanCursor(t *testing.T) {
+    c := dialTest(t, serveTest(t))
+    const keys = 25
+    for i := 0; i < keys; i++ {
+        c.expect("OK", "set", "k"+strconv.Itoa(i), "v")
+    }
+    seen := make(map[string]bool)
+    cursor := "0"
+    for calls := 0; ; calls++ {
+        if calls > keys {
+            t.Fatal("scan does not end")
+        }
+        reply := c.do("scan", cursor, "count", "10")
+        // [cursor [key ...]]
+        fields := strings.Fields(strings.Trim(reply, "[]"))
+        if len(fields) == 0 {
+            t.Fatalf("reply %q", reply)
+        }
+        cursor = fields[0]
+        if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+            t.Fatalf("cursor %q: %v", cursor, err)
+        }
+        for _, k := range fields[1:] {
+            seen[k] = true
+        }
+        if cursor == "0" {
+            break
+        }
+    }
+    if len(seen) != keys {
+        t.Fatalf("scanned %d keys, want %d", len(seen), keys)
+    }
+    c.expect("-ERR invalid cursor", "scan", "abc")
+}
@@ -0,0 +1,474 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store/tuple"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// A list holds its elements at the indexes [head, tail) of its meta. Pushing
+// to the left decrements head, pushing to the right increments tail.
+
+// listMeta returns the head and tail of the list key, which does not exist
+// when both are zero.
+func (k *keyspace) listMeta(key []byte) (int64, int64, error) {
+    meta, err := k.lookup(key, typeList)
+    return count(meta, 1), count(meta, 2), err
+}
+
+// setList records the new bounds of the list key, deleting it when it is
+// empty.
+func (k *keyspace) setList(key []byte, head, tail int64) error {
+    if head == tail {
+        return k.drop(key)
+    }
+    return k.setMeta(key, tuple.Tuple{typeList, head, tail})
+}
+
+// push adds values to the left or right of the list key, creating it when
+// needed, and returns the new length.
+func (k *keyspace) push(key []byte, left bool, values [][]byte) (int64, error) {
+    meta, err := k.open(key, tuple.Tuple{typeList, int64(0), int64(0)})
+    if err != nil {
+        return 0, err
+    }
+    head, tail := count(meta, 1), count(meta, 2)
+    for _, v := range values {
+        if left {
+            head--
+            err = k.aux.Put(pack(key, "l", head), v)
+        } else {
+            err = k.aux.Put(pack(key, "l", tail), v)
+            tail++
+        }
+        if err != nil {
+            return 0, err
+        }
+    }
+    if left {
+        k.notify(notifyList, "lpush", key)
+    } else {
+        k.notify(notifyList, "rpush", key)
+    }
+    return tail - head, k.setList(key, head, tail)
+}
+
+// pop removes up to n values from the left or right of the list key.
+func (k *keyspace) pop(key []byte, left bool, n int64) ([][]byte, error) {
+    head, tail, err := k.listMeta(key)
+    if err != nil || head == tail {
+        return nil, err
+    }
+    var values [][]byte
+    for ; n > 0 && head < tail; n-- {
+        i := head
+        if left {
+            head++
+        } else {
+            tail--
+            i = tail
+        }
+        v, err := k.aux.Get(pack(key, "l", i))
+        if err != nil {
+            return nil, err
+        }
+        if err := k.aux.Del(pack(key, "l", i)); err != nil {
+            return nil, err
+        }
+        values = append(values, v)
+    }
+    if left {
+        k.notify(notifyList, "lpop", key)
+    } else {
+        k.notify(notifyList, "rpop", key)
+    }
+    return values, k.setList(key, head, tail)
+}
+
+// move pops a value from the left or right of the list src and pushes it to
+// the left or right of the list dst, returning nil when src is empty.
+func (k *keyspace) move(src, dst []byte, fromLeft, toLeft bool) ([]byte, error) {
+    head, tail, err := k.listMeta(src)
+    if err != nil || head == tail {
+        return nil, err
+    }
+    if _, _, err := k.listMeta(dst); err != nil {
+        return nil, err
+    }
+    values, err := k.pop(src, fromLeft, 1)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := k.push(dst, toLeft, values); err != nil {
+        return nil, err
+    }
+    return values[0], nil
+}
+
+// listRange returns the absolute indexes [start, stop] of the list elements
+// selected by the redis indexes start and stop, or false when none is.
+func listRange(head, tail, start, stop int64) (int64, int64, bool) {
+    n := tail - head
+    if start < 0 {
+        start += n
+    }
+    if stop < 0 {
+        stop += n
+    }
+    if start < 0 {
+        start = 0
+    }
+    if stop >= n {
+        stop = n - 1
+    }
+    if start > stop {
+        return 0, 0, false
+    }
+    return head + start, head + stop, true
+}
+
+// listIndex returns the absolute index of the element at the redis index i.
+func listIndex(head, tail, i int64) (int64, bool) {
+    if i < 0 {
+        i += tail - head
+    }
+    if i < 0 || i >= tail-head {
+        return 0, false
+    }
+    return head + i, true
+}
+
+func cmdPush(c *client, args [][]byte) {
+    left := strings.ToLower(string(args[0])) == "lpush"
+    var n int64
+    err := c.update(func(k *keyspace) (err error) {
+        n, err = k.push(args[1], left, args[2:])
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+func cmdPop(c *client, args [][]byte) {
+    left := strings.ToLower(string(args[0])) == "lpop"
+    n := int64(1)
+    if len(args) > 3 {
+        writeError(c.conn, errSyntax)
+        return
+    }
+    if len(args) == 3 {
+        var err error
+        if n, err = parseInt(args[2]); err != nil || n < 0 {
+            writeError(c.conn, replyError("ERR value is out of range, must be positive"))
+            return
+        }
+    }
+    var values [][]byte
+    err := c.update(func(k *keyspace) (err error) {
+        values, err = k.pop(args[1], left, n)
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case len(args) == 3 && values == nil:
+        c.conn.WriteNull()
+    case len(args) == 3:
+        writeBulks(c.conn, values)
+    case values == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(values[0])
+    }
+}
+func cmdLLen(c *client, args [][]byte) {
+    var n int64
+    err := c.view(func(k *keyspace) error {
+        head, tail, err := k.listMeta(args[1])
+        n = tail - head
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+func cmdLRange(c *client, args [][]byte) {
+    start, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    stop, err := parseInt(args[3])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    values := [][]byte{}
+    err = c.view(func(k *keyspace) error {
+        head, tail, err := k.listMeta(args[1])
+        if err != nil {
+            return err
+        }
+        first, last, ok := listRange(head, tail, start, stop)
+        if !ok {
+            return nil
+        }
+        return k.aux.Range(pack(args[1], "l", first), pack(args[1], "l", last+1), func(_ []byte, value []byte) bool {
+            values = append(values, value)
+            return true
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeBulks(c.conn, values)
+}
+func cmdLIndex(c *client, args [][]byte) {
+    i, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var value []byte
+    err = c.view(func(k *keyspace) error {
+        head, tail, err := k.listMeta(args[1])
+        if err != nil {
+            return err
+        }
+        at, ok := listIndex(head, tail, i)
+        if !ok {
+            return nil
+        }
+        value, err = k.aux.Get(pack(args[1], "l", at))
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case value == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(value)
+    }
+}
+func cmdLSet(c *client, args [][]byte) {
+    i, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    err = c.update(func(k *keyspace) error {
+        head, tail, err := k.listMeta(args[1])
+        if err != nil {
+            return err
+        }
+        if head == tail {
+            return replyError("ERR no such key")
+        }
+        at, ok := listIndex(head, tail, i)
+        if !ok {
+            return replyError("ERR index out of range")
+        }
+        k.notify(notifyList, "lset", args[1])
+        return k.aux.Put(pack(args[1], "l", at), args[3])
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteString("OK")
+    }
+}
+func cmdLTrim(c *client, args [][]byte) {
+    start, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    stop, err := parseInt(args[3])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    err = c.update(func(k *keyspace) error {
+        head, tail, err := k.listMeta(args[1])
+        if err != nil || head == tail {
+            return err
+        }
+        k.notify(notifyList, "ltrim", args[1])
+        first, last, ok := listRange(head, tail, start, stop)
+        if !ok {
+            return k.drop(args[1])
+        }
+        var drop [][]byte
+        collect := func(key []byte, _ []byte) bool {
+            drop = append(drop, key)
+            return true
+        }
+        if err := k.aux.Range(pack(args[1], "l", head), pack(args[1], "l", first), collect, keysOnly); err != nil {
+            return err
+        }
+        if err := k.aux.Range(pack(args[1], "l", last+1), pack(args[1], "l", tail), collect, keysOnly); err != nil {
+            return err
+        }
+        for _, key := range drop {
+            if err := k.aux.Del(key); err != nil {
+                return err
+            }
+        }
+        return k.setList(args[1], first, last+1)
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteString("OK")
+    }
+}
+
+// parseSide parses the LEFT or RIGHT argument of LMOVE and BLMOVE.
+func parseSide(arg []byte) (bool, error) {
+    switch strings.ToLower(string(arg)) {
+    case "left":
+        return true, nil
+    case "right":
+        return false, nil
+    }
+    return false, errSyntax
+}
+
+// parseTimeout parses the timeout in seconds of the blocking pops, 0 to
+// block forever.
+func parseTimeout(arg []byte) (time.Duration, error) {
+    f, err := strconv.ParseFloat(string(arg), 64)
+    if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f > float64(math.MaxInt64/time.Second) {
+        return 0, replyError("ERR timeout is not a float or out of range")
+    }
+    if f < 0 {
+        return 0, replyError("ERR timeout is negative")
+    }
+    d := time.Duration(f * float64(time.Second))
+    if d == 0 && f > 0 {
+        d = 1
+    }
+    return d, nil
+}
+
+// cmdLMove implements LMOVE source destination LEFT|RIGHT LEFT|RIGHT and
+// RPOPLPUSH source destination.
+func cmdLMove(c *client, args [][]byte) {
+    fromLeft, toLeft := false, true
+    if len(args) == 5 {
+        var err error
+        if fromLeft, err = parseSide(args[3]); err == nil {
+            toLeft, err = parseSide(args[4])
+        }
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+    }
+    var value []byte
+    err := c.update(func(k *keyspace) (err error) {
+        value, err = k.move(args[1], args[2], fromLeft, toLeft)
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case value == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(value)
+    }
+}
+
+// cmdBPop implements BLPOP and BRPOP key [key ...] timeout: it pops from the
+// first of the keys that is not empty, or blocks until one of them is pushed
+// to. Clients blocked on a key are served in the order they blocked.
+func cmdBPop(c *client, args [][]byte) {
+    left := strings.ToLower(string(args[0])) == "blpop"
+    keys := args[1 : len(args)-1]
+    timeout, err := parseTimeout(args[len(args)-1])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    pop := func() bool {
+        var key, value []byte
+        err := c.update(func(k *keyspace) error {
+            key, value = nil, nil
+            for _, arg := range keys {
+                values, err := k.pop(arg, left, 1)
+                if err != nil {
+                    return err
+                }
+                if values != nil {
+                    key, value = arg, values[0]
+                    return nil
+                }
+            }
+            return nil
+        })
+        switch {
+        case err != nil:
+            writeError(c.conn, err)
+        case value == nil:
+            return false
+        default:
+            c.conn.WriteArray(2)
+            c.conn.WriteBulk(key)
+            c.conn.WriteBulk(value)
+        }
+        return true
+    }
+    if !pop() && !c.block(keys, timeout, true, pop) {
+        c.conn.WriteArray(-1) // null array
+    }
+}
+
+// cmdBLMove implements BLMOVE source destination LEFT|RIGHT LEFT|RIGHT
+// timeout and BRPOPLPUSH source destination timeout, the blocking forms of
+// LMOVE and RPOPLPUSH.
+func cmdBLMove(c *client, args [][]byte) {
+    fromLeft, toLeft := false, true
+    if len(args) == 6 {
+        var err error
+        if fromLeft, err = parseSide(args[3]); err == nil {
+            toLeft, err = parseSide(args[4])
+        }
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+    }
+    timeout, err := parseTimeout(args[len(args)-1])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    move := func() bool {
+        var value []byte
+        err := c.update(func(k *keyspace) (err error) {
+            value, err = k.move(args[1], args[2], fromLeft, toLeft)
+            return err
+        })
+        switch {
+        case err != nil:
+            writeError(c.conn, err)
+        case value == nil:
+            return false
+        default:
+            c.conn.WriteBulk(value)
+        }
+        return true
+    }
+    if !move() && !c.block(args[1:2], timeout, true, move) {
+        c.conn.WriteNull()
+    }
+}
@@ -0,0 +1,124 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store/tuple"
+    "strings"
+)
+
+// TupleMatch returns a SCAN MATCH pattern for the keys packed by package
+// tuple that have more elements than prefix and start with its elements,
+// the keys tuple.Range covers.
+func TupleMatch(prefix tuple.Tuple) (string, error) {
+    p, err := tuple.Pack(prefix)
+    if err != nil {
+        return "", err
+    }
+    var sb strings.Builder
+    for _, c := range p {
+        switch c {
+        case '*', '?', '[', ']', '\\':
+            sb.WriteByte('\\')
+        }
+        sb.WriteByte(c)
+    }
+    // 0xff after a string or bytes element escapes a zero byte inside it,
+    // and never starts an element
+    sb.WriteString("[^\xff]*")
+    return sb.String(), nil
+}
+
+// globMatch reports whether s matches the glob pattern, with the syntax of
+// redis: the * and ? wildcards, [abc], [a-z] and [^abc] classes, and \ to
+// escape the next byte.
+func globMatch(pattern, s []byte) bool {
+    px, sx := 0, 0
+    // where to resume after the last *, letting it take one more byte
+    starP, starS := -1, -1
+    for px < len(pattern) || sx < len(s) {
+        if px < len(pattern) {
+            if pattern[px] == '*' {
+                starP, starS = px, sx+1
+                px++
+                continue
+            }
+            if sx < len(s) {
+                if n, ok := globByte(pattern[px:], s[sx]); ok {
+                    px += n
+                    sx++
+                    continue
+                }
+            }
+        }
+        if starP < 0 || starS > len(s) {
+            return false
+        }
+        px, sx = starP, starS
+    }
+    return true
+}
+
+// globByte matches c against the element at the start of p, which stands
+// for a single byte, and returns the length of the element.
+func globByte(p []byte, c byte) (int, bool) {
+    switch p[0] {
+    case '?':
+        return 1, true
+    case '\\':
+        if len(p) == 1 {
+            return 1, c == '\\'
+        }
+        return 2, p[1] == c
+    case '[':
+        return globClass(p, c)
+    }
+    return 1, p[0] == c
+}
+func globClass(p []byte, c byte) (int, bool) {
+    i := 1
+    not := i < len(p) && p[i] == '^'
+    if not {
+        i++
+    }
+    match := false
+    for ; i < len(p) && p[i] != ']'; i++ {
+        switch {
+        case p[i] == '\\' && i+1 < len(p):
+            i++
+            match = match || p[i] == c
+        case i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']':
+            lo, hi := p[i], p[i+2]
+            if lo > hi {
+                lo, hi = hi, lo
+            }
+            match = match || (lo <= c && c <= hi)
+            i += 2
+        default:
+            match = match || p[i] == c
+        }
+    }
+    if i < len(p) {
+        i++ // the closing ]
+    }
+    return i, match != not
+}
+
+// globPrefix returns the literal prefix of pattern, unescaped, and whether
+// pattern matches exactly the keys with that prefix.
+func globPrefix(pattern string) (string, bool) {
+    var sb strings.Builder
+    for i := 0; i < len(pattern); i++ {
+        switch c := pattern[i]; c {
+        case '\\':
+            if i+1 == len(pattern) {
+                return sb.String(), false
+            }
+            i++
+            sb.WriteByte(pattern[i])
+        case '*', '?', '[':
+            return sb.String(), pattern[i:] == "*"
+        default:
+            sb.WriteByte(c)
+        }
+    }
+    return sb.String(), false
+}
@@ -0,0 +1,242 @@
+package store_redis
+
+import (
+    "bytes"
+    "github.com/DGHeroin/redcon"
+    "github.com/DGHeroin/vault/store"
+    "strings"
+    "sync/atomic"
+)
+
+var (
+    errExecAbort = replyError("EXECABORT Transaction discarded because of previous errors.")
+    errNoMulti   = replyError("ERR Command not allowed inside a transaction")
+)
+
+// watchedKey follows the writes to a key from WATCH until EXEC: main sees
+// the key itself, aux the entries of non-string types.
+type watchedKey struct {
+    replaced  int32 // by SWAPDB or FLUSH*, set atomically; first for alignment
+    db        *database
+    key       []byte
+    main, aux *store.Watcher
+    dirty     bool
+}
+
+// changed drains the events seen so far. A watcher that stopped, which it
+// does when it falls behind, counts as a change.
+func (w *watchedKey) changed() bool {
+    if atomic.LoadInt32(&w.replaced) != 0 {
+        w.dirty = true
+    }
+    for _, watcher := range []*store.Watcher{w.main, w.aux} {
+        for drained := false; !drained && !w.dirty; {
+            select {
+            case ev, ok := <-watcher.C:
+                // main also sees the keys w.key is a prefix of
+                w.dirty = !ok || watcher == w.aux || bytes.Equal(ev.Key, w.key)
+            default:
+                drained = true
+            }
+        }
+    }
+    return w.dirty
+}
+func (w *watchedKey) close() {
+    w.db.dropWatched(w)
+    w.main.Close()
+    w.aux.Close()
+}
+
+// queue adds a command to the transaction started by MULTI.
+func (c *client) queue(cmd *command, args [][]byte) {
+    switch cmd.name {
+    case "subscribe", "psubscribe", "detach":
+        c.abort()
+        writeError(c.conn, errNoMulti)
+        return
+    }
+    queued := make([][]byte, len(args))
+    for i, arg := range args {
+        queued[i] = append([]byte(nil), arg...)
+    }
+    c.queued = append(c.queued, queued)
+    c.conn.WriteString("QUEUED")
+}
+
+// abort makes the EXEC of a transaction being queued fail.
+func (c *client) abort() {
+    c.aborted = c.multi
+}
+func (c *client) unwatch() {
+    for _, w := range c.watched {
+        w.close()
+    }
+    c.watched = nil
+}
+
+// touched reports whether any of the watched keys was written since WATCH.
+// It runs inside the EXEC transaction: the events of earlier commits are
+// already queued to the watchers, and reading the keys makes later commits
+// conflict with it: writes to the elements of a key rewrite its main entry
+// too.
+func touched(tx *store.Tx, watched []*watchedKey) (bool, error) {
+    dirty := false
+    for _, w := range watched {
+        if _, _, err := w.db.keyspace(tx).meta(w.key); err != nil {
+            return false, err
+        }
+        if w.changed() {
+            dirty = true
+        }
+    }
+    return dirty, nil
+}
+
+func cmdMulti(c *client, args [][]byte) {
+    if c.multi {
+        writeError(c.conn, replyError("ERR MULTI calls can not be nested"))
+        return
+    }
+    c.multi = true
+    c.conn.WriteString("OK")
+}
+
+// cmdExec runs the queued commands in a single transaction, so their writes
+// are committed as one batch. Replies are buffered as the transaction may be
+// retried. A transaction with SWAPDB or FLUSH* holds dbMu exclusively, and
+// starts each try from the databases as they were.
+func cmdExec(c *client, args [][]byte) {
+    if !c.multi {
+        writeError(c.conn, replyError("ERR EXEC without MULTI"))
+        return
+    }
+    queued, aborted, watched := c.queued, c.aborted, c.watched
+    c.multi, c.queued, c.aborted, c.watched = false, nil, false, nil
+    defer func() {
+        for _, w := range watched {
+            w.close()
+        }
+    }()
+    if aborted {
+        writeError(c.conn, errExecAbort)
+        return
+    }
+    exclusive := false
+    for _, args := range queued {
+        switch strings.ToLower(string(args[0])) {
+        case "swapdb", "flushdb", "flushall":
+            exclusive = true
+        }
+    }
+    s := c.s
+    var dbs []*database
+    if exclusive {
+        s.dbMu.Lock()
+        defer s.dbMu.Unlock()
+        dbs = append(dbs, s.dbs...)
+    } else {
+        s.dbMu.RLock()
+        defer s.dbMu.RUnlock()
+    }
+    conn, replies := c.conn, &replyBuffer{Conn: c.conn}
+    var dirty bool
+    err := c.updateLocked(func(k *keyspace) (err error) {
+        copy(s.dbs, dbs)
+        if dirty, err = touched(k.tx, watched); err != nil || dirty {
+            return err
+        }
+        replies.b = replies.b[:0]
+        c.conn, c.tx = replies, k.tx
+        defer func() {
+            c.conn, c.tx = conn, nil
+        }()
+        for _, args := range queued {
+            commands[strings.ToLower(string(args[0]))].fn(c, args)
+        }
+        return nil
+    })
+    if err != nil {
+        copy(s.dbs, dbs)
+    }
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case dirty:
+        c.conn.WriteArray(-1) // null array
+    default:
+        c.conn.WriteArray(len(queued))
+        c.conn.WriteRaw(replies.b)
+    }
+}
+func cmdDiscard(c *client, args [][]byte) {
+    if !c.multi {
+        writeError(c.conn, replyError("ERR DISCARD without MULTI"))
+        return
+    }
+    c.multi, c.queued, c.aborted = false, nil, false
+    c.unwatch()
+    c.conn.WriteString("OK")
+}
+func cmdWatch(c *client, args [][]byte) {
+    if c.multi {
+        writeError(c.conn, replyError("ERR WATCH inside MULTI is not allowed"))
+        return
+    }
+    // registered under dbMu, so a SWAPDB or FLUSH* either sees the key or
+    // ran before it was watched
+    c.s.dbMu.RLock()
+    defer c.s.dbMu.RUnlock()
+    db := c.s.dbs[c.db]
+    for _, arg := range args[1:] {
+        w := &watchedKey{db: db, key: append([]byte(nil), arg...)}
+        w.main, w.aux = db.watch(w.key)
+        db.addWatched(w)
+        c.watched = append(c.watched, w)
+    }
+    c.conn.WriteString("OK")
+}
+func cmdUnwatch(c *client, args [][]byte) {
+    c.unwatch()
+    c.conn.WriteString("OK")
+}
+
+// replyBuffer collects the replies of the commands run by EXEC.
+type replyBuffer struct {
+    redcon.Conn
+    b []byte
+}
+
+func (r *replyBuffer) WriteError(msg string) {
+    r.b = redcon.AppendError(r.b, msg)
+}
+func (r *replyBuffer) WriteString(str string) {
+    r.b = redcon.AppendString(r.b, str)
+}
+func (r *replyBuffer) WriteBulk(bulk []byte) {
+    r.b = redcon.AppendBulk(r.b, bulk)
+}
+func (r *replyBuffer) WriteBulkString(bulk string) {
+    r.b = redcon.AppendBulkString(r.b, bulk)
+}
+func (r *replyBuffer) WriteInt(num int) {
+    r.b = redcon.AppendInt(r.b, int64(num))
+}
+func (r *replyBuffer) WriteInt64(num int64) {
+    r.b = redcon.AppendInt(r.b, num)
+}
+func (r *replyBuffer) WriteUint64(num uint64) {
+    r.b = redcon.AppendUint(r.b, num)
+}
+func (r *replyBuffer) WriteArray(count int) {
+    r.b = redcon.AppendArray(r.b, count)
+}
+func (r *replyBuffer) WriteNull() {
+    r.b = redcon.AppendNull(r.b)
+}
+func (r *replyBuffer) WriteRaw(data []byte) {
+    r.b = append(r.b, data...)
+}
+func (r *replyBuffer) WriteAny(any interface{}) {
+    r.b = redcon.AppendAny(r.b, any)
+}
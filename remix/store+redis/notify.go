@@ -0,0 +1,254 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+    "log"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// Keyspace notifications, enabled by the notify-keyspace-events parameter
+// as in redis: K and E pick the channels, the other flags the classes of
+// events published.
+const (
+    notifyKeyspace = 1 << iota // K
+    notifyKeyevent             // E
+    notifyGeneric              // g
+    notifyString               // $
+    notifyList                 // l
+    notifySet                  // s
+    notifyHash                 // h
+    notifyZSet                 // z
+    notifyExpired              // x
+    notifyEvicted              // e
+    notifyStream               // t
+
+    notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted | notifyStream // A
+)
+
+// notifyFlags lists the flags in the order redis prints them.
+const notifyFlags = "g$lshzxet"
+
+func parseNotify(s string) (uint32, error) {
+    var flags uint32
+    for _, c := range s {
+        switch c {
+        case 'A':
+            flags |= notifyAll
+        case 'K':
+            flags |= notifyKeyspace
+        case 'E':
+            flags |= notifyKeyevent
+        default:
+            i := strings.IndexRune(notifyFlags, c)
+            if i < 0 {
+                return 0, errSyntax
+            }
+            flags |= notifyGeneric << i
+        }
+    }
+    return flags, nil
+}
+func formatNotify(flags uint32) string {
+    var sb strings.Builder
+    if flags&notifyAll == notifyAll {
+        sb.WriteByte('A')
+    } else {
+        for i := range notifyFlags {
+            if flags&(notifyGeneric<<i) != 0 {
+                sb.WriteByte(notifyFlags[i])
+            }
+        }
+    }
+    if flags&notifyKeyspace != 0 {
+        sb.WriteByte('K')
+    }
+    if flags&notifyKeyevent != 0 {
+        sb.WriteByte('E')
+    }
+    return sb.String()
+}
+
+// keyEvent is a notification waiting for its transaction to commit.
+type keyEvent struct {
+    db    int
+    class uint32
+    event string
+    key   []byte
+}
+
+// notify records that event of class happened to key. Nothing is recorded
+// in read-only keyspaces.
+func (k *keyspace) notify(class uint32, event string, key []byte) {
+    if k.events != nil {
+        *k.events = append(*k.events, keyEvent{db: k.db, class: class, event: event, key: key})
+    }
+}
+
+// publish sends the notifications enabled for events.
+func (s *server) publish(events []keyEvent) {
+    flags := atomic.LoadUint32(&s.notify)
+    if flags&(notifyKeyspace|notifyKeyevent) == 0 {
+        return
+    }
+    for _, ev := range events {
+        if flags&ev.class == 0 {
+            continue
+        }
+        db := strconv.Itoa(ev.db)
+        if flags&notifyKeyspace != 0 {
+            s.ps.Publish("__keyspace@"+db+"__:"+string(ev.key), ev.event)
+        }
+        if flags&notifyKeyevent != 0 {
+            s.ps.Publish("__keyevent@"+db+"__:"+ev.event, string(ev.key))
+        }
+    }
+}
+
+// expiredBatch bounds the expired keys cleared in one transaction, and
+// sweepBatch the aux entries walked in one by a sweep.
+const (
+    expiredBatch = 256
+    sweepBatch   = 1024
+)
+
+// watchExpired publishes the expired events of the keys of d reaped by the
+// store, and deletes what they kept in the aux bucket, until the server or the
+// store is closed. When events are lost, the aux bucket is swept for the keys
+// they were about.
+func (s *server) watchExpired(d *database) {
+    for {
+        w := d.watchMain(nil, &store.WatchOptions{Buffer: 4 * expiredBatch, Types: []store.EventType{store.EventExpire}})
+        for open := true; open; {
+            select {
+            case <-s.done:
+                w.Close()
+                return
+            case ev, ok := <-w.C:
+                if open = ok; !ok {
+                    break
+                }
+                // take what else is already there
+                keys := [][]byte{ev.Key}
+            drain:
+                for len(keys) < expiredBatch {
+                    select {
+                    case ev, ok := <-w.C:
+                        if open = ok; !ok {
+                            break drain
+                        }
+                        keys = append(keys, ev.Key)
+                    default:
+                        break drain
+                    }
+                }
+                d.add(-int64(len(keys)), -int64(len(keys)))
+                s.clearExpired(d, keys)
+                events, db := make([]keyEvent, len(keys)), s.dbNumber(d)
+                for i, key := range keys {
+                    events[i] = keyEvent{db: db, class: notifyExpired, event: "expired", key: key}
+                }
+                s.publish(events)
+            }
+        }
+        if w.Err() != store.ErrWatchOverflow {
+            return
+        }
+        // some events were lost: carry on with the next ones, once the keys
+        // they were about are cleared and counted
+        s.sweepExpired(d)
+        if err := d.count(); err != nil {
+            log.Printf("count keys: %v", err)
+        }
+    }
+}
+
+// clearExpired deletes the aux entries of keys, reaped from d by the store,
+// but for those created again since.
+func (s *server) clearExpired(d *database, keys [][]byte) {
+    s.dbMu.RLock()
+    defer s.dbMu.RUnlock()
+    for {
+        err := s.store.Update(func(tx *store.Tx) error {
+            k := d.keyspace(tx)
+            for _, key := range keys {
+                if _, err := k.main.Get(key); err == nil {
+                    continue
+                } else if err != store.ErrNotFound {
+                    return err
+                }
+                if err := k.clearStale(key); err != nil {
+                    return err
+                }
+            }
+            return nil
+        })
+        if err != store.ErrConflict {
+            return
+        }
+    }
+}
+
+// sweepExpired deletes the aux entries of the keys of d that are gone, a
+// batch of entries at a time.
+func (s *server) sweepExpired(d *database) {
+    var after []byte
+    for more := true; more; {
+        select {
+        case <-s.done:
+            return
+        default:
+        }
+        var last []byte
+        err := s.sweepStep(d, after, &last)
+        if err == store.ErrConflict {
+            continue
+        }
+        if err != nil {
+            log.Printf("sweep expired keys: %v", err)
+            return
+        }
+        after, more = last, last != nil
+    }
+}
+
+// sweepStep clears the keys gone among the next sweepBatch aux entries after
+// after, and sets last to the last of those entries, nil once there are none
+// left.
+func (s *server) sweepStep(d *database, after []byte, last *[]byte) error {
+    s.dbMu.RLock()
+    defer s.dbMu.RUnlock()
+    return s.store.Update(func(tx *store.Tx) error {
+        k := d.keyspace(tx)
+        *last = nil
+        var metas [][]byte
+        n := 0
+        err := k.aux.Range(nil, nil, func(aux []byte, _ []byte) bool {
+            if n++; n == sweepBatch {
+                *last = aux
+            }
+            if t, err := tuple.Unpack(aux); err == nil && len(t) == 1 {
+                if key, ok := t[0].([]byte); ok {
+                    metas = append(metas, key)
+                }
+            }
+            return true
+        }, &store.RangeOptions{KeysOnly: true, After: after, Max: sweepBatch})
+        if err != nil {
+            return err
+        }
+        for _, key := range metas {
+            if _, err := k.main.Get(key); err == nil {
+                continue
+            } else if err != store.ErrNotFound {
+                return err
+            }
+            if err := k.clearAux(key); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
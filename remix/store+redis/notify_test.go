@@ -0,0 +1,75 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+    "strconv"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestExpiredAuxCleared(t *testing.T) {
+    st, err := store.New(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer st.Close()
+    s, err := newServer(st, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer close(s.done)
+    d := s.dbs[0]
+    // hold the cleanup back until the reaper got ahead of it
+    s.dbMu.Lock()
+    const keys = 1500 // more than the watcher buffers and a batch being cleared hold
+    for i := 0; i < keys; i += 500 {
+        err := st.Update(func(tx *store.Tx) error {
+            k := d.keyspace(tx)
+            for j := i; j < i+500; j++ {
+                key := []byte("h" + strconv.Itoa(j))
+                if err := k.create(key, tuple.Tuple{typeHash, int64(1)}); err != nil {
+                    return err
+                }
+                if err := k.aux.Put(pack(key, "h", "f"), []byte("v")); err != nil {
+                    return err
+                }
+                if err := k.main.Expire(key, time.Millisecond); err != nil {
+                    return err
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    waitFor(t, "keys reaped", func() bool {
+        n := 0
+        _ = st.Range(nil, nil, func(_, _ []byte) bool {
+            n++
+            return true
+        }, keysOnly)
+        return n == 0
+    })
+    s.dbMu.Unlock()
+    waitFor(t, "aux cleared", func() bool {
+        n := 0
+        _ = d.aux.Range(nil, nil, func(_, _ []byte) bool {
+            n++
+            return true
+        }, keysOnly)
+        return n == 0 && atomic.LoadInt64(&d.keys) == 0
+    })
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    for deadline := time.Now().Add(time.Minute); !cond(); {
+        if time.Now().After(deadline) {
+            t.Fatal("timed out waiting for " + what)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
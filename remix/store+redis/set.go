@@ -0,0 +1,109 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+)
+
+func cmdSAdd(c *client, args [][]byte) {
+    var added int64
+    err := c.update(func(k *keyspace) error {
+        added = 0
+        meta, err := k.open(args[1], tuple.Tuple{typeSet, int64(0)})
+        if err != nil {
+            return err
+        }
+        for _, member := range args[2:] {
+            aux := pack(args[1], "s", member)
+            if _, err := k.aux.Get(aux); err == nil {
+                continue
+            } else if err != store.ErrNotFound {
+                return err
+            }
+            if err := k.aux.Put(aux, nil); err != nil {
+                return err
+            }
+            added++
+        }
+        if added > 0 {
+            k.notify(notifySet, "sadd", args[1])
+        }
+        return k.setMeta(args[1], tuple.Tuple{typeSet, count(meta, 1) + added})
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(added)
+    }
+}
+func cmdSRem(c *client, args [][]byte) {
+    var removed int64
+    err := c.update(func(k *keyspace) error {
+        removed = 0
+        meta, err := k.lookup(args[1], typeSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        for _, member := range args[2:] {
+            aux := pack(args[1], "s", member)
+            if _, err := k.aux.Get(aux); err == store.ErrNotFound {
+                continue
+            } else if err != nil {
+                return err
+            }
+            if err := k.aux.Del(aux); err != nil {
+                return err
+            }
+            removed++
+        }
+        if removed > 0 {
+            k.notify(notifySet, "srem", args[1])
+        }
+        if n := count(meta, 1) - removed; n > 0 {
+            return k.setMeta(args[1], tuple.Tuple{typeSet, n})
+        }
+        return k.drop(args[1])
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(removed)
+    }
+}
+func cmdSMembers(c *client, args [][]byte) {
+    members := [][]byte{}
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        return k.members(args[1], "s", func(elems tuple.Tuple, _ []byte) bool {
+            member, _ := elems[0].([]byte)
+            members = append(members, member)
+            return true
+        }, keysOnly)
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeBulks(c.conn, members)
+}
+func cmdSIsMember(c *client, args [][]byte) {
+    var ok bool
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        _, err = k.aux.Get(pack(args[1], "s", args[2]))
+        if ok = err == nil; err == store.ErrNotFound {
+            return nil
+        }
+        return err
+    })
+    writeBool(c, ok, err)
+}
+func cmdSCard(c *client, args [][]byte) {
+    writeCount(c, args[1], typeSet)
+}
@@ -1,7 +1,6 @@
 package store_redis
 
 import (
-    "bytes"
     "crypto/tls"
     "fmt"
     "github.com/DGHeroin/redcon"
@@ -10,328 +9,529 @@ import (
     "net"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "time"
 )
 
-func Serve(store *store.Store, ln net.Listener) error {
-    var ps redcon.PubSub
-    return redcon.Serve(ln, acceptCommand(&ps, store),
-        func(conn redcon.Conn) bool {
-            // Use this function to accept or deny the connection.
-            // log.Printf("accept: %s", conn.RemoteAddr())
-            return true
-        },
-        func(conn redcon.Conn, err error) {
-            // This is called when the connection has been closed
-            // log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
-        })
+// version is reported to clients as the redis version served.
+const version = "6.2.0"
+
+// keysOnly is used by commands that only look at key names.
+var keysOnly = &store.RangeOptions{KeysOnly: true}
+
+var (
+    errWrongType  = replyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+    errNotInteger = replyError("ERR value is not an integer or out of range")
+    errNotFloat   = replyError("ERR value is not a valid float")
+    errOverflow   = replyError("ERR increment or decrement would overflow")
+    errSyntax     = replyError("ERR syntax error")
+)
+
+type (
+    server struct {
+        lastID      uint64 // of the clients, first for atomic alignment
+        processed   uint64 // commands run since start
+        connections uint64 // accepted since start
+        rejected    uint64 // connections refused over maxclients
+        started     time.Time
+        store       *store.Store
+        ps          redcon.PubSub
+        cursors     cursors
+        users       map[string]*account
+
+        dbMu  sync.RWMutex // held by commands, exclusively to swap or flush
+        dbs   []*database  // by logical number
+        dbMap *store.Bucket
+
+        clientsMu sync.Mutex
+        clients   map[uint64]*client // connected, by id
+
+        blockMu sync.Mutex
+        blocked map[blockKey][]*waiter // in the order they blocked
+
+        // runtime settings, accessed atomically
+        notify     uint32 // notify-keyspace-events flags
+        maxClients uint32
+        timeout    int64 // seconds a client may idle, forever when 0
+
+        done chan struct{}
+    }
+    // client is the state of a connection, kept in its context.
+    client struct {
+        s    *server
+        conn redcon.Conn
+        tx   *store.Tx // transaction of the running EXEC
+        id   uint64
+        name string
+        user *account // nil until authenticated
+        db   int
+
+        addr    string
+        netConn net.Conn // under conn, closed to kill the client from another goroutine
+        created time.Time
+        mu      sync.Mutex // guards info
+        info    clientInfo
+
+        waiting  *waiter             // set while blocked
+        serving  bool                // detached to block, run by serve since
+        parked   redcon.DetachedConn // until redcon lets go of the connection
+        detached bool                // for pub/sub
+
+        events []keyEvent // of the running transaction
+        counts []keyCount // of the running transaction
+
+        multi   bool
+        queued  [][][]byte
+        aborted bool
+        watched []*watchedKey
+    }
+    command struct {
+        name  string
+        arity int // number of arguments including the name, -n for at least n
+        fn    func(c *client, args [][]byte)
+        // positions of the key arguments: from first to last, -1 for the
+        // last argument, every step; 0 when there are none
+        first, last, step int
+    }
+    // replyError is sent to the client as is.
+    replyError string
+)
+
+func (e replyError) Error() string {
+    return string(e)
 }
-func ServeTLS(store *store.Store, addr string, config *tls.Config) error {
-    var ps redcon.PubSub
-    return redcon.ListenAndServeTLS(addr, acceptCommand(&ps, store),
-        func(conn redcon.Conn) bool {
-            // Use this function to accept or deny the connection.
-            // log.Printf("accept: %s", conn.RemoteAddr())
-            return true
-        },
-        func(conn redcon.Conn, err error) {
-            // This is called when the connection has been closed
-            // log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
-        }, config)
+
+// movableKeys finds the keys of the commands whose key positions vary.
+var movableKeys = map[string]func(args [][]byte) [][]byte{
+    "xread":      streamsKeys,
+    "xreadgroup": streamsKeys,
 }
-func acceptCommand(ps *redcon.PubSub, store *store.Store) func(conn redcon.Conn, cmd redcon.Command) {
-    return func(conn redcon.Conn, cmd redcon.Command) {
-        defer func() {
-            if e := recover(); e != nil {
-                conn.WriteError("ERR  '" + fmt.Sprint(e) + "'")
-            }
-        }()
-        switch strings.ToLower(string(cmd.Args[0])) {
-        default:
-            fmt.Println(string(cmd.Args[0]))
-            conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
-        case "publish":
-            // Publish to all pub/sub subscribers and return the number of
-            // messages that were sent.
-            if len(cmd.Args) != 3 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            count := ps.Publish(string(cmd.Args[1]), string(cmd.Args[2]))
-            conn.WriteInt(count)
-        case "subscribe", "psubscribe":
-            // Subscribe to a pub/sub channel. The `Psubscribe` and
-            // `Subscribe` operations will detach the connection from the
-            // event handler and manage all network I/O for this connection
-            // in the background.
-            if len(cmd.Args) < 2 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            command := strings.ToLower(string(cmd.Args[0]))
-            for i := 1; i < len(cmd.Args); i++ {
-                if command == "psubscribe" {
-                    ps.Psubscribe(conn, string(cmd.Args[i]))
-                } else {
-                    ps.Subscribe(conn, string(cmd.Args[i]))
-                }
-            }
-        case "detach":
-            conn2 := conn.Detach()
-            log.Printf("connection has been detached")
-            go func() {
-                defer func() {
-                    _ = conn2.Close()
-                }()
-                conn2.WriteString("OK")
-                _ = conn2.Flush()
-            }()
-        case "ping":
-            conn.WriteString("PONG")
-        case "quit":
-            conn.WriteString("OK")
-            _ = conn.Close()
-        case "set":
-            if len(cmd.Args) != 3 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            if err := store.Put(cmd.Args[1], cmd.Args[2]); err != nil {
-                conn.WriteError("ERR '" + err.Error() + "'")
-            } else {
-                conn.WriteString("OK")
-            }
 
-        case "get":
-            if len(cmd.Args) != 2 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            if val, err := store.Get(cmd.Args[1]); err != nil {
-                conn.WriteError("ERR '" + err.Error() + "'")
-            } else {
-                if val == nil {
-                    conn.WriteNull()
-                } else {
-                    conn.WriteBulk(val)
-                }
-            }
-        case "del":
-            if len(cmd.Args) != 2 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            if err := store.Del(cmd.Args[1]); err != nil {
-                conn.WriteError("ERR '" + err.Error() + "'")
-            } else {
-                conn.WriteString("OK")
-            }
-        case "config":
-            if len(cmd.Args) != 3 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            // This simple (blank) response is only here to allow for the
-            // redis-benchmark command to work with this example.
-            conn.WriteArray(2)
-            conn.WriteBulk(cmd.Args[2])
-            conn.WriteBulkString("")
-        case "type":
-            conn.WriteString("string")
-        case "keys":
-            if len(cmd.Args) != 2 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            var (
-                k   [][]byte
-                v   [][]byte
-                err error
-            )
-            if bytes.Compare(cmd.Args[1], []byte("*")) == 0 {
-                err = store.Range(nil, nil, func(key []byte, value []byte) bool {
-                    k = append(k, key)
-                    v = append(v, value)
-                    return true
-                })
-            } else {
-                err = store.RangePrefix(cmd.Args[1], func(key []byte, value []byte) bool {
-                    k = append(k, key)
-                    v = append(v, value)
-                    return true
-                })
-            }
-            if err != nil {
-                conn.WriteError("ERR '" + err.Error() + "'")
-                return
-            }
+// keys returns the key arguments of the command line args.
+func (cmd *command) keys(args [][]byte) [][]byte {
+    if fn := movableKeys[cmd.name]; fn != nil {
+        return fn(args)
+    }
+    if cmd.first == 0 {
+        return nil
+    }
+    last := cmd.last
+    if last < 0 {
+        last += len(args)
+    }
+    var keys [][]byte
+    for i := cmd.first; i <= last && i < len(args); i += cmd.step {
+        keys = append(keys, args[i])
+    }
+    return keys
+}
 
-            conn.WriteArray(len(k))
-            for i := 0; i < len(k); i++ {
-                conn.WriteString(string(k[i]))
-            }
-        case "scan":
-            var (
-                match  string
-                cursor int
-                count  int
-
-                keys []string
-            )
-            sz := len(cmd.Args)
-            if sz%2 != 0 {
-                conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-                return
-            }
-            for i := 0; i < sz; i += 2 {
-                t := string(cmd.Args[i])
-                val := string(cmd.Args[i+1])
-                switch strings.ToLower(t) {
-                case "scan":
-                    cursor, _ = strconv.Atoi(val)
-                case "match":
-                    match = val
-                case "count":
-                    count, _ = strconv.Atoi(val)
-                }
-            }
-            curCursor := 0
-            matchN := 0
-            isBreakByCount := false
-
-            if strings.Count(match, "*") == 1 && strings.HasSuffix(match, "*") {
-                prefix := strings.ReplaceAll(match, "*", "")
-                err := store.RangePrefix([]byte(prefix), func(k, value []byte) bool {
-                    if match != "" {
-                        if stringGlob(match, string(k)) {
-                            if cursor > 0 && curCursor < cursor {
-                                curCursor++
-                                return true
-                            }
-                            keys = append(keys, string(k))
-                            matchN++
-                        } else {
-                            // 不匹配
-                            return true
-                        }
-                    } else {
-                        if cursor > 0 && curCursor < cursor {
-                            curCursor++
-                            return true
-                        }
-
-                        keys = append(keys, string(k))
-                        matchN++
-                    }
-                    curCursor++
-                    // check limit
-                    if count != 0 {
-                        if matchN >= count {
-                            isBreakByCount = true
-                            return false
-                        }
-                    }
-                    return true
-                })
-                if err != nil {
-                    conn.WriteError("ERR '" + err.Error() + "'")
-                    return
-                }
-            } else { // match ?
-                err := store.Range(nil, nil, func(key, _ []byte) bool {
-                    k := string(key)
-                    if match != "" {
-                        if stringGlob(match, k) {
-                            if cursor > 0 && curCursor < cursor {
-                                curCursor++
-                                return true
-                            }
-                            keys = append(keys, k)
-                            matchN++
-                        } else {
-                            // 不匹配
-                            return true
-                        }
-                    } else {
-                        if cursor > 0 && curCursor < cursor {
-                            curCursor++
-                            return true
-                        }
-
-                        keys = append(keys, k)
-                        matchN++
-                    }
-                    curCursor++
-                    // check limit
-                    if count != 0 {
-                        if matchN >= count {
-                            isBreakByCount = true
-                            return false
-                        }
-                    }
-                    return true
-                })
-                if err != nil {
-                    conn.WriteError("ERR '" + err.Error() + "'")
-                    return
-                }
-                if !isBreakByCount {
-                    curCursor = 0
-                }
-            }
-            if len(keys) == 0 {
-                conn.WriteArray(2)
-                conn.WriteBulkString(fmt.Sprint(0))
-                conn.WriteArray(matchN)
-                for _, key := range keys {
-                    conn.WriteBulkString(key)
-                }
-                return
-            }
-            conn.WriteArray(2)
-            conn.WriteString(fmt.Sprint(curCursor))
-            conn.WriteArray(matchN)
-            for _, key := range keys {
-                conn.WriteBulkString(key)
-            }
+var commands = make(map[string]*command)
+
+func init() {
+    for _, cmd := range []*command{
+        {"publish", 3, cmdPublish, 0, 0, 0},
+        {"subscribe", -2, cmdSubscribe, 0, 0, 0},
+        {"psubscribe", -2, cmdSubscribe, 0, 0, 0},
+        {"detach", 1, cmdDetach, 0, 0, 0},
+        {"ping", 1, cmdPing, 0, 0, 0},
+        {"quit", 1, cmdQuit, 0, 0, 0},
+        {"auth", -2, cmdAuth, 0, 0, 0},
+        {"hello", -1, cmdHello, 0, 0, 0},
+        {"acl", -2, cmdACL, 0, 0, 0},
+        {"config", -2, cmdConfig, 0, 0, 0},
+        {"info", -1, cmdInfo, 0, 0, 0},
+        {"command", -1, cmdCommand, 0, 0, 0},
+        {"client", -2, cmdClient, 0, 0, 0},
+        {"time", 1, cmdTime, 0, 0, 0},
+
+        {"multi", 1, cmdMulti, 0, 0, 0},
+        {"exec", 1, cmdExec, 0, 0, 0},
+        {"discard", 1, cmdDiscard, 0, 0, 0},
+        {"watch", -2, cmdWatch, 1, -1, 1},
+        {"unwatch", 1, cmdUnwatch, 0, 0, 0},
+
+        {"get", 2, cmdGet, 1, 1, 1},
+        {"set", -3, cmdSet, 1, 1, 1},
+        {"setnx", 3, cmdSetNX, 1, 1, 1},
+        {"incr", 2, cmdIncr, 1, 1, 1},
+        {"decr", 2, cmdIncr, 1, 1, 1},
+        {"incrby", 3, cmdIncrBy, 1, 1, 1},
+        {"decrby", 3, cmdIncrBy, 1, 1, 1},
+        {"incrbyfloat", 3, cmdIncrByFloat, 1, 1, 1},
+        {"mget", -2, cmdMGet, 1, -1, 1},
+        {"mset", -3, cmdMSet, 1, -1, 2},
+        {"msetnx", -3, cmdMSet, 1, -1, 2},
+        {"getset", 3, cmdGetSet, 1, 1, 1},
+        {"getdel", 2, cmdGetSet, 1, 1, 1},
+        {"append", 3, cmdAppend, 1, 1, 1},
+        {"strlen", 2, cmdStrLen, 1, 1, 1},
+        {"getrange", 4, cmdGetRange, 1, 1, 1},
+        {"setrange", 4, cmdSetRange, 1, 1, 1},
+
+        {"expire", -3, cmdExpire, 1, 1, 1},
+        {"pexpire", -3, cmdExpire, 1, 1, 1},
+        {"expireat", -3, cmdExpire, 1, 1, 1},
+        {"pexpireat", -3, cmdExpire, 1, 1, 1},
+        {"ttl", 2, cmdTTL, 1, 1, 1},
+        {"pttl", 2, cmdTTL, 1, 1, 1},
+        {"persist", 2, cmdPersist, 1, 1, 1},
+
+        {"select", 2, cmdSelect, 0, 0, 0},
+        {"swapdb", 3, cmdSwapDB, 0, 0, 0},
+        {"move", 3, cmdMove, 1, 1, 1},
+        {"dbsize", 1, cmdDBSize, 0, 0, 0},
+        {"flushdb", -1, cmdFlush, 0, 0, 0},
+        {"flushall", -1, cmdFlush, 0, 0, 0},
+
+        {"del", -2, cmdDel, 1, -1, 1},
+        {"unlink", -2, cmdDel, 1, -1, 1},
+        {"exists", -2, cmdExists, 1, -1, 1},
+        {"rename", 3, cmdRename, 1, 2, 1},
+        {"renamenx", 3, cmdRename, 1, 2, 1},
+        {"copy", -3, cmdCopy, 1, 2, 1},
+        {"type", 2, cmdType, 1, 1, 1},
+        {"keys", 2, cmdKeys, 0, 0, 0},
+        {"scan", -2, cmdScan, 0, 0, 0},
+
+        {"hset", -4, cmdHSet, 1, 1, 1},
+        {"hmset", -4, cmdHSet, 1, 1, 1},
+        {"hsetnx", 4, cmdHSetNX, 1, 1, 1},
+        {"hget", 3, cmdHGet, 1, 1, 1},
+        {"hmget", -3, cmdHMGet, 1, 1, 1},
+        {"hgetall", 2, cmdHGetAll, 1, 1, 1},
+        {"hkeys", 2, cmdHGetAll, 1, 1, 1},
+        {"hvals", 2, cmdHGetAll, 1, 1, 1},
+        {"hdel", -3, cmdHDel, 1, 1, 1},
+        {"hlen", 2, cmdHLen, 1, 1, 1},
+        {"hexists", 3, cmdHExists, 1, 1, 1},
+        {"hincrby", 4, cmdHIncrBy, 1, 1, 1},
+
+        {"lpush", -3, cmdPush, 1, 1, 1},
+        {"rpush", -3, cmdPush, 1, 1, 1},
+        {"lpop", -2, cmdPop, 1, 1, 1},
+        {"rpop", -2, cmdPop, 1, 1, 1},
+        {"llen", 2, cmdLLen, 1, 1, 1},
+        {"lrange", 4, cmdLRange, 1, 1, 1},
+        {"lindex", 3, cmdLIndex, 1, 1, 1},
+        {"lset", 4, cmdLSet, 1, 1, 1},
+        {"ltrim", 4, cmdLTrim, 1, 1, 1},
+        {"lmove", 5, cmdLMove, 1, 2, 1},
+        {"rpoplpush", 3, cmdLMove, 1, 2, 1},
+        {"blpop", -3, cmdBPop, 1, -2, 1},
+        {"brpop", -3, cmdBPop, 1, -2, 1},
+        {"blmove", 6, cmdBLMove, 1, 2, 1},
+        {"brpoplpush", 4, cmdBLMove, 1, 2, 1},
+
+        {"sadd", -3, cmdSAdd, 1, 1, 1},
+        {"srem", -3, cmdSRem, 1, 1, 1},
+        {"smembers", 2, cmdSMembers, 1, 1, 1},
+        {"sismember", 3, cmdSIsMember, 1, 1, 1},
+        {"scard", 2, cmdSCard, 1, 1, 1},
+
+        {"zadd", -4, cmdZAdd, 1, 1, 1},
+        {"zincrby", 4, cmdZIncrBy, 1, 1, 1},
+        {"zrem", -3, cmdZRem, 1, 1, 1},
+        {"zscore", 3, cmdZScore, 1, 1, 1},
+        {"zcard", 2, cmdZCard, 1, 1, 1},
+        {"zrank", 3, cmdZRank, 1, 1, 1},
+        {"zrevrank", 3, cmdZRank, 1, 1, 1},
+        {"zrange", -4, cmdZRange, 1, 1, 1},
+        {"zrevrange", -4, cmdZRange, 1, 1, 1},
+        {"zrangebyscore", -4, cmdZRangeByScore, 1, 1, 1},
+        {"zrevrangebyscore", -4, cmdZRangeByScore, 1, 1, 1},
+        {"zcount", 4, cmdZCount, 1, 1, 1},
+
+        {"xadd", -5, cmdXAdd, 1, 1, 1},
+        {"xlen", 2, cmdXLen, 1, 1, 1},
+        {"xrange", -4, cmdXRange, 1, 1, 1},
+        {"xrevrange", -4, cmdXRange, 1, 1, 1},
+        {"xtrim", -4, cmdXTrim, 1, 1, 1},
+        {"xread", -4, cmdXRead, 0, 0, 0},
+        {"xreadgroup", -7, cmdXReadGroup, 0, 0, 0},
+        {"xgroup", -2, cmdXGroup, 2, 2, 1},
+        {"xack", -4, cmdXAck, 1, 1, 1},
+        {"xpending", -3, cmdXPending, 1, 1, 1},
+        {"xclaim", -6, cmdXClaim, 1, 1, 1},
+    } {
+        commands[cmd.name] = cmd
+    }
+}
+
+// Options configure Serve and ServeTLS. A nil *Options lets every client
+// run every command without authenticating.
+type Options struct {
+    // Users who may log in with AUTH or HELLO. Connections start logged in
+    // as the user named "default" when it has NoPass, and must
+    // authenticate before anything else otherwise.
+    Users []*User
+    // Databases is the number of logical databases, 16 when 0.
+    Databases int
+}
+
+func Serve(store *store.Store, ln net.Listener, opts ...*Options) error {
+    s, err := newServer(store, opts)
+    if err != nil {
+        return err
+    }
+    defer close(s.done)
+    return redcon.Serve(ln, s.handle, s.accept, s.closed)
+}
+func ServeTLS(store *store.Store, addr string, config *tls.Config, opts ...*Options) error {
+    s, err := newServer(store, opts)
+    if err != nil {
+        return err
+    }
+    defer close(s.done)
+    return redcon.ListenAndServeTLS(addr, s.handle, s.accept, s.closed, config)
+}
+func newServer(st *store.Store, opts []*Options) (*server, error) {
+    n := defaultDatabases
+    if len(opts) > 0 && opts[0] != nil && opts[0].Databases > 0 {
+        n = opts[0].Databases
+    }
+    dbs, dbMap, err := openDatabases(st, n)
+    if err != nil {
+        return nil, err
+    }
+    s := &server{
+        started:    time.Now(),
+        store:      st,
+        users:      newAccounts(opts),
+        dbs:        dbs,
+        dbMap:      dbMap,
+        clients:    make(map[uint64]*client),
+        blocked:    make(map[blockKey][]*waiter),
+        maxClients: defaultMaxClients,
+        done:       make(chan struct{}),
+    }
+    go s.reapIdle()
+    for _, d := range dbs {
+        go s.watchExpired(d)
+    }
+    return s, nil
+}
+func (s *server) accept(conn redcon.Conn) bool {
+    // log.Printf("accept: %s", conn.RemoteAddr())
+    atomic.AddUint64(&s.connections, 1)
+    if s.clientCount() >= int(atomic.LoadUint32(&s.maxClients)) {
+        atomic.AddUint64(&s.rejected, 1)
+        conn.WriteError("ERR max number of clients reached")
+        return false
+    }
+    conn.SetContext(s.newClient(conn))
+    return true
+}
+func (s *server) newClient(conn redcon.Conn) *client {
+    c := &client{s: s, conn: conn, id: atomic.AddUint64(&s.lastID, 1), addr: conn.RemoteAddr(), netConn: conn.NetConn(), created: time.Now()}
+    if a := s.users[defaultUser]; a != nil && a.nopass {
+        c.user = a
+    }
+    c.track("")
+    s.clientsMu.Lock()
+    s.clients[c.id] = c
+    s.clientsMu.Unlock()
+    return c
+}
+func (s *server) closed(conn redcon.Conn, err error) {
+    // log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
+    c, ok := conn.Context().(*client)
+    switch {
+    case !ok:
+    case c.parked != nil:
+        // redcon is done with the connection, serve can take it over
+        dc := c.parked
+        c.parked = nil
+        go c.serve(dc)
+    case !c.serving:
+        s.forget(c)
+    }
+}
+
+// forget drops a client that disconnected or was detached for pub/sub.
+func (s *server) forget(c *client) {
+    c.unwatch()
+    s.clientsMu.Lock()
+    delete(s.clients, c.id)
+    s.clientsMu.Unlock()
+}
+func (s *server) handle(conn redcon.Conn, cmd redcon.Command) {
+    defer func() {
+        if e := recover(); e != nil {
+            conn.WriteError("ERR  '" + fmt.Sprint(e) + "'")
+        }
+    }()
+    c, ok := conn.Context().(*client)
+    if !ok {
+        c = s.newClient(conn)
+        conn.SetContext(c)
+    }
+    command := commands[strings.ToLower(string(cmd.Args[0]))]
+    if command == nil {
+        fmt.Println(string(cmd.Args[0]))
+        c.abort()
+        conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+        return
+    }
+    if n := len(cmd.Args); (command.arity > 0 && n != command.arity) || n < -command.arity {
+        c.abort()
+        writeArgError(conn, cmd.Args[0])
+        return
+    }
+    if err := c.authorize(command, cmd.Args); err != nil {
+        c.abort()
+        writeError(conn, err)
+        return
+    }
+    atomic.AddUint64(&s.processed, 1)
+    c.track(command.name)
+    defer c.settle(conn, command.name)
+    if c.multi {
+        switch command.name {
+        case "multi", "exec", "discard", "watch", "quit":
+        default:
+            c.queue(command, cmd.Args)
+            return
         }
     }
+    command.fn(c, cmd.Args)
 }
 
-func stringGlob(pattern, subj string) bool {
-    if pattern == "" {
-        return subj == pattern
+// settle records the state of c after its command cmd, and parks the
+// connection when the command blocked.
+func (c *client) settle(conn redcon.Conn, cmd string) {
+    c.track(cmd)
+    if c.waiting != nil && !c.serving {
+        c.serving = true
+        c.parked = conn.Detach()
     }
+}
 
-    if pattern == "*" {
-        return true
+// update runs fn in a transaction over the keyspace, retrying it when it
+// conflicts with another writer.
+func (c *client) update(fn func(k *keyspace) error) error {
+    if c.tx != nil {
+        return fn(c.s.keyspace(c.tx, c.db, &c.events, &c.counts))
     }
+    c.s.dbMu.RLock()
+    defer c.s.dbMu.RUnlock()
+    return c.updateLocked(fn)
+}
 
-    parts := strings.Split(pattern, "*")
+// updateLocked is update for a caller holding dbMu.
+func (c *client) updateLocked(fn func(k *keyspace) error) error {
+    for {
+        c.events, c.counts = c.events[:0], c.counts[:0]
+        err := c.s.store.Update(func(tx *store.Tx) error {
+            return fn(c.s.keyspace(tx, c.db, &c.events, &c.counts))
+        })
+        if err == nil {
+            for _, n := range c.counts {
+                n.d.add(n.keys, n.expires)
+            }
+            c.s.publish(c.events)
+            c.s.ready(c.events)
+        }
+        if err != store.ErrConflict {
+            return err
+        }
+    }
+}
 
-    if len(parts) == 1 {
-        return subj == pattern
+// lockDBs takes dbMu, exclusively to change what the databases hold, and
+// returns its release. The commands run by EXEC find it held already.
+func (c *client) lockDBs(exclusive bool) func() {
+    switch {
+    case c.tx != nil:
+        return func() {}
+    case exclusive:
+        c.s.dbMu.Lock()
+        return c.s.dbMu.Unlock
     }
+    c.s.dbMu.RLock()
+    return c.s.dbMu.RUnlock
+}
 
-    leadingGlob := strings.HasPrefix(pattern, "*")
-    trailingGlob := strings.HasSuffix(pattern, "*")
-    end := len(parts) - 1
+// view runs fn against a consistent view of the keyspace.
+func (c *client) view(fn func(k *keyspace) error) error {
+    if c.tx != nil {
+        return fn(c.s.keyspace(c.tx, c.db, &c.events, &c.counts))
+    }
+    c.s.dbMu.RLock()
+    defer c.s.dbMu.RUnlock()
+    return c.s.store.View(func(tx *store.Tx) error {
+        return fn(c.s.dbs[c.db].keyspace(tx))
+    })
+}
 
-    for i := 0; i < end; i++ {
-        idx := strings.Index(subj, parts[i])
+func writeError(conn redcon.Conn, err error) {
+    if e, ok := err.(replyError); ok {
+        conn.WriteError(string(e))
+        return
+    }
+    conn.WriteError("ERR '" + err.Error() + "'")
+}
+func writeArgError(conn redcon.Conn, name []byte) {
+    conn.WriteError("ERR wrong number of arguments for '" + string(name) + "' command")
+}
 
-        switch i {
-        case 0:
-            if !leadingGlob && idx != 0 {
-                return false
-            }
-        default:
-            if idx < 0 {
-                return false
-            }
+// writeBulks replies with an array of bulk strings, nil ones as nulls.
+func writeBulks(conn redcon.Conn, values [][]byte) {
+    conn.WriteArray(len(values))
+    for _, v := range values {
+        if v == nil {
+            conn.WriteNull()
+        } else {
+            conn.WriteBulk(v)
         }
-
-        subj = subj[idx+len(parts[i]):]
     }
+}
+func parseInt(arg []byte) (int64, error) {
+    n, err := strconv.ParseInt(string(arg), 10, 64)
+    if err != nil {
+        return 0, errNotInteger
+    }
+    return n, nil
+}
 
-    return trailingGlob || strings.HasSuffix(subj, parts[end])
+func cmdPublish(c *client, args [][]byte) {
+    // Publish to all pub/sub subscribers and return the number of
+    // messages that were sent.
+    count := c.s.ps.Publish(string(args[1]), string(args[2]))
+    c.conn.WriteInt(count)
+}
+func cmdSubscribe(c *client, args [][]byte) {
+    // Subscribe to a pub/sub channel. The `Psubscribe` and
+    // `Subscribe` operations will detach the connection from the
+    // event handler and manage all network I/O for this connection
+    // in the background.
+    command := strings.ToLower(string(args[0]))
+    c.detached = true
+    for i := 1; i < len(args); i++ {
+        if command == "psubscribe" {
+            c.s.ps.Psubscribe(c.conn, string(args[i]))
+        } else {
+            c.s.ps.Subscribe(c.conn, string(args[i]))
+        }
+    }
+}
+func cmdDetach(c *client, args [][]byte) {
+    c.detached = true
+    conn2 := c.conn.Detach()
+    log.Printf("connection has been detached")
+    go func() {
+        defer func() {
+            _ = conn2.Close()
+        }()
+        conn2.WriteString("OK")
+        _ = conn2.Flush()
+    }()
+}
+func cmdPing(c *client, args [][]byte) {
+    c.conn.WriteString("PONG")
+}
+func cmdQuit(c *client, args [][]byte) {
+    c.conn.WriteString("OK")
+    _ = c.conn.Close()
 }
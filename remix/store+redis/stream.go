@@ -0,0 +1,1386 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/redcon"
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// A stream keeps its entries by id, and the state of its consumer groups
+// next to them. Its meta holds the length and the last id added, which stays
+// when entries are trimmed so that ids never go back.
+
+type (
+    streamID struct {
+        ms, seq uint64
+    }
+    streamEntry struct {
+        id     streamID
+        fields [][]byte // nil once deleted, when read from a pending list
+    }
+    streamMeta struct {
+        length int64
+        last   streamID
+    }
+    // pendingEntry is an entry delivered to a consumer of a group and not
+    // acknowledged yet.
+    pendingEntry struct {
+        id        streamID
+        consumer  []byte
+        delivered int64 // unix ms
+        count     int64 // deliveries
+    }
+    // streamTrim is the MAXLEN or MINID argument of XADD and XTRIM.
+    streamTrim struct {
+        minID  bool
+        maxLen int64
+        min    streamID
+        limit  int64 // entries deleted at most, unlimited when 0
+    }
+    // xreadArgs are the arguments of XREAD and XREADGROUP.
+    xreadArgs struct {
+        group, consumer []byte // of XREADGROUP
+        count           int64  // unlimited when 0
+        block           bool
+        timeout         time.Duration
+        noAck           bool
+        keys, ids       [][]byte
+    }
+    streamReply struct {
+        key     []byte
+        entries []streamEntry
+    }
+)
+
+var (
+    maxStreamID  = streamID{math.MaxUint64, math.MaxUint64}
+    errStreamID  = replyError("ERR Invalid stream ID specified as stream command argument")
+    errXAddOrder = replyError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+    errNoStream  = replyError("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+func (id streamID) String() string {
+    return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+func (id streamID) less(o streamID) bool {
+    return id.ms < o.ms || id.ms == o.ms && id.seq < o.seq
+}
+
+// next returns the id following id, false when id is the last possible.
+func (id streamID) next() (streamID, bool) {
+    switch {
+    case id.seq < math.MaxUint64:
+        return streamID{id.ms, id.seq + 1}, true
+    case id.ms < math.MaxUint64:
+        return streamID{id.ms + 1, 0}, true
+    }
+    return id, false
+}
+
+// prev returns the id before id, false when id is 0-0.
+func (id streamID) prev() (streamID, bool) {
+    switch {
+    case id.seq > 0:
+        return streamID{id.ms, id.seq - 1}, true
+    case id.ms > 0:
+        return streamID{id.ms - 1, math.MaxUint64}, true
+    }
+    return id, false
+}
+
+// parseStreamID parses ms-seq, or ms alone with seq as its sequence.
+func parseStreamID(arg []byte, seq uint64) (streamID, error) {
+    s, id := string(arg), streamID{seq: seq}
+    var err error
+    if i := strings.IndexByte(s, '-'); i >= 0 {
+        if id.seq, err = strconv.ParseUint(s[i+1:], 10, 64); err != nil {
+            return id, errStreamID
+        }
+        s = s[:i]
+    }
+    if id.ms, err = strconv.ParseUint(s, 10, 64); err != nil {
+        return id, errStreamID
+    }
+    return id, nil
+}
+
+// parseRangeID parses a bound of XRANGE: "-", "+", an id, or an id
+// excluded with "(". It reports false when an excluded id leaves nothing.
+func parseRangeID(arg []byte, end bool) (streamID, bool, error) {
+    switch string(arg) {
+    case "-":
+        return streamID{}, true, nil
+    case "+":
+        return maxStreamID, true, nil
+    }
+    var seq uint64
+    if end {
+        seq = math.MaxUint64
+    }
+    if len(arg) > 0 && arg[0] == '(' {
+        id, err := parseStreamID(arg[1:], seq)
+        if err != nil {
+            return id, false, err
+        }
+        if end {
+            id, ok := id.prev()
+            return id, ok, nil
+        }
+        id, ok := id.next()
+        return id, ok, nil
+    }
+    id, err := parseStreamID(arg, seq)
+    return id, true, err
+}
+
+// elemID decodes an id packed as two integers.
+func elemID(ms, seq interface{}) (streamID, bool) {
+    var id streamID
+    var ok1, ok2 bool
+    id.ms, ok1 = elemUint(ms)
+    id.seq, ok2 = elemUint(seq)
+    return id, ok1 && ok2
+}
+func elemUint(e interface{}) (uint64, bool) {
+    switch v := e.(type) {
+    case int64:
+        return uint64(v), v >= 0
+    case uint64:
+        return v, true
+    }
+    return 0, false
+}
+func nowMs() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// streamMeta returns the meta of the stream key, nil when it does not exist.
+func (k *keyspace) streamMeta(key []byte) (*streamMeta, error) {
+    meta, err := k.lookup(key, typeStream)
+    if err != nil || meta == nil {
+        return nil, err
+    }
+    if len(meta) != 4 {
+        return nil, errCorrupt
+    }
+    last, ok := elemID(meta[2], meta[3])
+    if !ok {
+        return nil, errCorrupt
+    }
+    return &streamMeta{length: count(meta, 1), last: last}, nil
+}
+
+// openStream returns the meta of the stream key, creating it empty when
+// needed.
+func (k *keyspace) openStream(key []byte) (*streamMeta, error) {
+    m, err := k.streamMeta(key)
+    if err != nil || m != nil {
+        return m, err
+    }
+    m = &streamMeta{}
+    return m, k.create(key, tuple.Tuple{typeStream, m.length, m.last.ms, m.last.seq})
+}
+func (k *keyspace) setStream(key []byte, m *streamMeta) error {
+    return k.setMeta(key, tuple.Tuple{typeStream, m.length, m.last.ms, m.last.seq})
+}
+
+// streamRange walks the entries of key with ids in [start, end], backwards
+// when reverse, until fn returns false.
+func (k *keyspace) streamRange(key []byte, start, end streamID, reverse bool, fn func(e streamEntry) bool) error {
+    if end.less(start) {
+        return nil
+    }
+    from, to := pack(key, "x", start.ms, start.seq), append(pack(key, "x", end.ms, end.seq), 0)
+    var perr error
+    err := k.aux.Range(from, to, func(aux []byte, value []byte) bool {
+        var e streamEntry
+        if e, perr = decodeEntry(aux, value); perr != nil {
+            return false
+        }
+        return fn(e)
+    }, &store.RangeOptions{Reverse: reverse})
+    if err != nil {
+        return err
+    }
+    return perr
+}
+func decodeEntry(aux, value []byte) (streamEntry, error) {
+    id, err := entryID(aux)
+    if err != nil {
+        return streamEntry{}, err
+    }
+    fields, err := unpackFields(value)
+    return streamEntry{id: id, fields: fields}, err
+}
+func entryID(aux []byte) (streamID, error) {
+    t, err := tuple.Unpack(aux)
+    if err != nil || len(t) != 4 {
+        return streamID{}, errCorrupt
+    }
+    id, ok := elemID(t[2], t[3])
+    if !ok {
+        return streamID{}, errCorrupt
+    }
+    return id, nil
+}
+func unpackFields(value []byte) ([][]byte, error) {
+    t, err := tuple.Unpack(value)
+    if err != nil {
+        return nil, errCorrupt
+    }
+    fields := make([][]byte, len(t))
+    for i, e := range t {
+        if fields[i], _ = e.([]byte); fields[i] == nil {
+            return nil, errCorrupt
+        }
+    }
+    return fields, nil
+}
+
+// entry returns the fields of the entry id of key, nil when there is none.
+func (k *keyspace) entry(key []byte, id streamID) ([][]byte, error) {
+    value, err := k.aux.Get(pack(key, "x", id.ms, id.seq))
+    if err == store.ErrNotFound {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return unpackFields(value)
+}
+
+// entriesAfter returns up to n entries of key with ids after id, all when n
+// is 0.
+func (k *keyspace) entriesAfter(key []byte, id streamID, n int64) ([]streamEntry, error) {
+    start, ok := id.next()
+    if !ok {
+        return nil, nil
+    }
+    var entries []streamEntry
+    err := k.streamRange(key, start, maxStreamID, false, func(e streamEntry) bool {
+        entries = append(entries, e)
+        return n == 0 || int64(len(entries)) < n
+    })
+    return entries, err
+}
+
+// addEntry appends an entry to the stream key with the id, or the next
+// automatic one when id is nil.
+func (k *keyspace) addEntry(key []byte, m *streamMeta, id *streamID, fields [][]byte) (streamID, error) {
+    var added streamID
+    if id == nil {
+        now := uint64(nowMs())
+        if m.last.ms < now {
+            added = streamID{ms: now}
+        } else if next, ok := m.last.next(); ok {
+            added = next
+        } else {
+            return added, replyError("ERR The stream has exhausted the last possible ID, unable to add more items")
+        }
+    } else {
+        if !m.last.less(*id) {
+            return added, errXAddOrder
+        }
+        added = *id
+    }
+    elems := make([]interface{}, len(fields))
+    for i, f := range fields {
+        elems[i] = f
+    }
+    if err := k.aux.Put(pack(key, "x", added.ms, added.seq), pack(elems...)); err != nil {
+        return added, err
+    }
+    m.length++
+    m.last = added
+    k.notify(notifyStream, "xadd", key)
+    return added, nil
+}
+
+// trimStream deletes the entries of key that t drops, oldest first, and
+// returns how many it deleted.
+func (k *keyspace) trimStream(key []byte, m *streamMeta, t *streamTrim) (int64, error) {
+    start, limit, err := tuple.Range(tuple.Tuple{key, "x"})
+    if err != nil {
+        return 0, err
+    }
+    var drop [][]byte
+    var perr error
+    err = k.aux.Range(start, limit, func(aux []byte, _ []byte) bool {
+        if t.limit > 0 && int64(len(drop)) >= t.limit {
+            return false
+        }
+        if t.minID {
+            var id streamID
+            if id, perr = entryID(aux); perr != nil || !id.less(t.min) {
+                return false
+            }
+        } else if m.length-int64(len(drop)) <= t.maxLen {
+            return false
+        }
+        drop = append(drop, aux)
+        return true
+    }, keysOnly)
+    if err != nil {
+        return 0, err
+    }
+    if perr != nil {
+        return 0, perr
+    }
+    for _, aux := range drop {
+        if err := k.aux.Del(aux); err != nil {
+            return 0, err
+        }
+    }
+    if len(drop) > 0 {
+        m.length -= int64(len(drop))
+        k.notify(notifyStream, "xtrim", key)
+    }
+    return int64(len(drop)), nil
+}
+
+// parseTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] at args[i] and
+// returns the index following it.
+func parseTrim(args [][]byte, i int) (*streamTrim, int, error) {
+    t := &streamTrim{minID: strings.ToLower(string(args[i])) == "minid"}
+    i++
+    approx := false
+    if i < len(args) && (string(args[i]) == "=" || string(args[i]) == "~") {
+        approx = string(args[i]) == "~"
+        i++
+    }
+    if i >= len(args) {
+        return nil, i, errSyntax
+    }
+    if t.minID {
+        id, err := parseStreamID(args[i], 0)
+        if err != nil {
+            return nil, i, err
+        }
+        t.min = id
+    } else {
+        n, err := parseInt(args[i])
+        if err != nil {
+            return nil, i, err
+        }
+        if n < 0 {
+            return nil, i, replyError("ERR The MAXLEN argument must be >= 0.")
+        }
+        t.maxLen = n
+    }
+    i++
+    if i+1 < len(args) && strings.ToLower(string(args[i])) == "limit" {
+        if !approx {
+            return nil, i, replyError("ERR syntax error, LIMIT cannot be used without the special ~ option")
+        }
+        n, err := parseInt(args[i+1])
+        if err != nil || n < 0 {
+            return nil, i, replyError("ERR The LIMIT argument must be >= 0.")
+        }
+        t.limit = n
+        i += 2
+    }
+    return t, i, nil
+}
+
+// group returns the last id delivered to group of the stream key, false
+// when the stream or the group does not exist.
+func (k *keyspace) group(key, group []byte) (streamID, bool, error) {
+    m, err := k.streamMeta(key)
+    if err != nil || m == nil {
+        return streamID{}, false, err
+    }
+    data, err := k.aux.Get(pack(key, "g", group))
+    if err == store.ErrNotFound {
+        return streamID{}, false, nil
+    } else if err != nil {
+        return streamID{}, false, err
+    }
+    t, err := tuple.Unpack(data)
+    if err != nil || len(t) != 2 {
+        return streamID{}, false, errCorrupt
+    }
+    last, ok := elemID(t[0], t[1])
+    if !ok {
+        return streamID{}, false, errCorrupt
+    }
+    return last, true, nil
+}
+func (k *keyspace) setGroup(key, group []byte, last streamID) error {
+    return k.aux.Put(pack(key, "g", group), pack(last.ms, last.seq))
+}
+
+// touchConsumer records that consumer of group was seen, and reports
+// whether it is new.
+func (k *keyspace) touchConsumer(key, group, consumer []byte) (bool, error) {
+    aux := pack(key, "c", group, consumer)
+    _, err := k.aux.Get(aux)
+    if err != nil && err != store.ErrNotFound {
+        return false, err
+    }
+    if err == store.ErrNotFound {
+        k.notify(notifyStream, "xgroup-createconsumer", key)
+    }
+    return err == store.ErrNotFound, k.aux.Put(aux, pack(nowMs()))
+}
+
+// pendingRange walks the pending entries of group with ids in [start, end].
+func (k *keyspace) pendingRange(key, group []byte, start, end streamID, fn func(p *pendingEntry) bool) error {
+    if end.less(start) {
+        return nil
+    }
+    from, to := pack(key, "p", group, start.ms, start.seq), append(pack(key, "p", group, end.ms, end.seq), 0)
+    var perr error
+    err := k.aux.Range(from, to, func(aux []byte, value []byte) bool {
+        t, err := tuple.Unpack(aux)
+        if err != nil || len(t) != 5 {
+            perr = errCorrupt
+            return false
+        }
+        id, ok := elemID(t[3], t[4])
+        if !ok {
+            perr = errCorrupt
+            return false
+        }
+        var p *pendingEntry
+        if p, perr = decodePending(id, value); perr != nil {
+            return false
+        }
+        return fn(p)
+    })
+    if err != nil {
+        return err
+    }
+    return perr
+}
+func decodePending(id streamID, value []byte) (*pendingEntry, error) {
+    t, err := tuple.Unpack(value)
+    if err != nil || len(t) != 3 {
+        return nil, errCorrupt
+    }
+    consumer, ok := t[0].([]byte)
+    if !ok {
+        return nil, errCorrupt
+    }
+    return &pendingEntry{id: id, consumer: consumer, delivered: count(t, 1), count: count(t, 2)}, nil
+}
+
+// pending returns the pending entry id of group, nil when there is none.
+func (k *keyspace) pending(key, group []byte, id streamID) (*pendingEntry, error) {
+    value, err := k.aux.Get(pack(key, "p", group, id.ms, id.seq))
+    if err == store.ErrNotFound {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return decodePending(id, value)
+}
+func (k *keyspace) putPending(key, group []byte, p *pendingEntry) error {
+    return k.aux.Put(pack(key, "p", group, p.id.ms, p.id.seq), pack(p.consumer, p.delivered, p.count))
+}
+func (k *keyspace) delPending(key, group []byte, id streamID) error {
+    return k.aux.Del(pack(key, "p", group, id.ms, id.seq))
+}
+
+// dropGroup deletes group of the stream key with its consumers and pending
+// entries.
+func (k *keyspace) dropGroup(key, group []byte) error {
+    keys := [][]byte{pack(key, "g", group)}
+    for _, kind := range []string{"c", "p"} {
+        start, limit, err := tuple.Range(tuple.Tuple{key, kind, group})
+        if err != nil {
+            return err
+        }
+        err = k.aux.Range(start, limit, func(aux []byte, _ []byte) bool {
+            keys = append(keys, aux)
+            return true
+        }, keysOnly)
+        if err != nil {
+            return err
+        }
+    }
+    for _, aux := range keys {
+        if err := k.aux.Del(aux); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// dropConsumer deletes consumer of group and its pending entries, and
+// returns how many were pending.
+func (k *keyspace) dropConsumer(key, group, consumer []byte) (int64, error) {
+    var ids []streamID
+    err := k.pendingRange(key, group, streamID{}, maxStreamID, func(p *pendingEntry) bool {
+        if string(p.consumer) == string(consumer) {
+            ids = append(ids, p.id)
+        }
+        return true
+    })
+    if err != nil {
+        return 0, err
+    }
+    for _, id := range ids {
+        if err := k.delPending(key, group, id); err != nil {
+            return 0, err
+        }
+    }
+    return int64(len(ids)), k.aux.Del(pack(key, "c", group, consumer))
+}
+
+func writeEntries(conn redcon.Conn, entries []streamEntry) {
+    conn.WriteArray(len(entries))
+    for _, e := range entries {
+        conn.WriteArray(2)
+        conn.WriteBulkString(e.id.String())
+        if e.fields == nil {
+            conn.WriteNull()
+            continue
+        }
+        conn.WriteArray(len(e.fields))
+        for _, f := range e.fields {
+            conn.WriteBulk(f)
+        }
+    }
+}
+func writeStreams(c *client, replies []streamReply) {
+    c.conn.WriteArray(len(replies))
+    for _, r := range replies {
+        c.conn.WriteArray(2)
+        c.conn.WriteBulk(r.key)
+        writeEntries(c.conn, r.entries)
+    }
+}
+
+// cmdXAdd implements XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold
+// [LIMIT count]] *|id field value [field value ...].
+func cmdXAdd(c *client, args [][]byte) {
+    var (
+        noMkStream bool
+        trim       *streamTrim
+        err        error
+    )
+    i := 2
+options:
+    for ; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "nomkstream":
+            noMkStream = true
+        case "maxlen", "minid":
+            if trim, i, err = parseTrim(args, i); err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            i--
+        default:
+            break options
+        }
+    }
+    if i >= len(args) || (len(args)-i)%2 != 1 || len(args)-i < 3 {
+        writeArgError(c.conn, args[0])
+        return
+    }
+    var id *streamID
+    if string(args[i]) != "*" {
+        explicit, err := parseStreamID(args[i], 0)
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+        if explicit == (streamID{}) {
+            writeError(c.conn, replyError("ERR The ID specified in XADD must be greater than 0-0"))
+            return
+        }
+        id = &explicit
+    }
+    var added *streamID
+    err = c.update(func(k *keyspace) error {
+        added = nil
+        m, err := k.streamMeta(args[1])
+        if err != nil || m == nil && noMkStream {
+            return err
+        }
+        if m == nil {
+            if m, err = k.openStream(args[1]); err != nil {
+                return err
+            }
+        }
+        a, err := k.addEntry(args[1], m, id, args[i+1:])
+        if err != nil {
+            return err
+        }
+        if trim != nil {
+            if _, err := k.trimStream(args[1], m, trim); err != nil {
+                return err
+            }
+        }
+        added = &a
+        return k.setStream(args[1], m)
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case added == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulkString(added.String())
+    }
+}
+func cmdXLen(c *client, args [][]byte) {
+    var n int64
+    err := c.view(func(k *keyspace) error {
+        m, err := k.streamMeta(args[1])
+        if m != nil {
+            n = m.length
+        }
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+
+// cmdXRange implements XRANGE key start end [COUNT count] and XREVRANGE key
+// end start [COUNT count].
+func cmdXRange(c *client, args [][]byte) {
+    reverse := strings.ToLower(string(args[0])) == "xrevrange"
+    lo, hi := args[2], args[3]
+    if reverse {
+        lo, hi = hi, lo
+    }
+    start, ok1, err := parseRangeID(lo, false)
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    end, ok2, err := parseRangeID(hi, true)
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    n, limited := int64(0), false
+    switch {
+    case len(args) == 6 && strings.ToLower(string(args[4])) == "count":
+        if n, err = parseInt(args[5]); err != nil {
+            writeError(c.conn, err)
+            return
+        }
+        limited = true
+    case len(args) != 4:
+        writeError(c.conn, errSyntax)
+        return
+    }
+    entries := []streamEntry{}
+    if ok1 && ok2 && (!limited || n > 0) {
+        err = c.view(func(k *keyspace) error {
+            if _, err := k.lookup(args[1], typeStream); err != nil {
+                return err
+            }
+            return k.streamRange(args[1], start, end, reverse, func(e streamEntry) bool {
+                entries = append(entries, e)
+                return !limited || int64(len(entries)) < n
+            })
+        })
+    }
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeEntries(c.conn, entries)
+}
+
+// cmdXTrim implements XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count].
+func cmdXTrim(c *client, args [][]byte) {
+    switch strings.ToLower(string(args[2])) {
+    case "maxlen", "minid":
+    default:
+        writeError(c.conn, errSyntax)
+        return
+    }
+    trim, i, err := parseTrim(args, 2)
+    if err == nil && i != len(args) {
+        err = errSyntax
+    }
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var n int64
+    err = c.update(func(k *keyspace) error {
+        m, err := k.streamMeta(args[1])
+        if err != nil || m == nil {
+            return err
+        }
+        if n, err = k.trimStream(args[1], m, trim); err != nil || n == 0 {
+            return err
+        }
+        return k.setStream(args[1], m)
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+
+// parseXRead parses the arguments of XREAD, or of XREADGROUP when group.
+func parseXRead(args [][]byte, group bool) (*xreadArgs, error) {
+    x := &xreadArgs{}
+    i := 1
+    if group {
+        if len(args) < 4 || strings.ToLower(string(args[1])) != "group" {
+            return nil, errSyntax
+        }
+        x.group, x.consumer, i = args[2], args[3], 4
+    }
+    for ; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "count":
+            if i+1 >= len(args) {
+                return nil, errSyntax
+            }
+            n, err := parseInt(args[i+1])
+            if err != nil {
+                return nil, err
+            }
+            if n > 0 {
+                x.count = n
+            }
+            i++
+        case "block":
+            if i+1 >= len(args) {
+                return nil, errSyntax
+            }
+            ms, err := parseInt(args[i+1])
+            if err != nil {
+                return nil, replyError("ERR timeout is not an integer or out of range")
+            }
+            if ms < 0 {
+                return nil, replyError("ERR timeout is negative")
+            }
+            x.block, x.timeout = true, time.Duration(ms)*time.Millisecond
+            i++
+        case "noack":
+            if !group {
+                return nil, errSyntax
+            }
+            x.noAck = true
+        case "streams":
+            rest := args[i+1:]
+            if len(rest) == 0 || len(rest)%2 != 0 {
+                return nil, replyError("ERR Unbalanced '" + strings.ToLower(string(args[0])) + "' list of streams: for each stream key an ID or '$' must be specified.")
+            }
+            x.keys, x.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+            return x, nil
+        default:
+            return nil, errSyntax
+        }
+    }
+    return nil, errSyntax
+}
+
+// streamsKeys returns the keys of XREAD and XREADGROUP.
+func streamsKeys(args [][]byte) [][]byte {
+    x, err := parseXRead(args, strings.ToLower(string(args[0])) == "xreadgroup")
+    if err != nil {
+        return nil
+    }
+    return x.keys
+}
+
+// cmdXRead implements XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...]
+// id [id ...].
+func cmdXRead(c *client, args [][]byte) {
+    x, err := parseXRead(args, false)
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    after := make([]*streamID, len(x.ids)) // nil for $, the last id
+    for i, arg := range x.ids {
+        switch string(arg) {
+        case "$":
+        case ">":
+            writeError(c.conn, replyError("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option."))
+            return
+        default:
+            id, err := parseStreamID(arg, 0)
+            if err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            after[i] = &id
+        }
+    }
+    read := func() ([]streamReply, error) {
+        var replies []streamReply
+        err := c.view(func(k *keyspace) error {
+            for i, key := range x.keys {
+                m, err := k.streamMeta(key)
+                if err != nil {
+                    return err
+                }
+                if after[i] == nil {
+                    // $ stands for the last id when XREAD is first run
+                    after[i] = &streamID{}
+                    if m != nil {
+                        after[i] = &m.last
+                    }
+                    continue
+                }
+                if m == nil {
+                    continue
+                }
+                entries, err := k.entriesAfter(key, *after[i], x.count)
+                if err != nil {
+                    return err
+                }
+                if len(entries) > 0 {
+                    replies = append(replies, streamReply{key: key, entries: entries})
+                }
+            }
+            return nil
+        })
+        return replies, err
+    }
+    replies, err := read()
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case len(replies) > 0:
+        writeStreams(c, replies)
+    case !x.block || !c.block(x.keys, x.timeout, false, func() bool {
+        replies, err := read()
+        if err != nil {
+            writeError(c.conn, err)
+            return true
+        }
+        if len(replies) == 0 {
+            return false
+        }
+        writeStreams(c, replies)
+        return true
+    }):
+        c.conn.WriteArray(-1) // null array
+    }
+}
+
+// cmdXReadGroup implements XREADGROUP GROUP group consumer [COUNT count]
+// [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]. The id > reads the
+// entries never delivered to the group, any other id the history of the
+// consumer after it.
+func cmdXReadGroup(c *client, args [][]byte) {
+    x, err := parseXRead(args, true)
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    after := make([]*streamID, len(x.ids)) // nil for >
+    for i, arg := range x.ids {
+        switch string(arg) {
+        case ">":
+        case "$":
+            writeError(c.conn, replyError("ERR The $ ID is meaningful only for XREAD command"))
+            return
+        default:
+            id, err := parseStreamID(arg, 0)
+            if err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            after[i] = &id
+        }
+    }
+    read := func() ([]streamReply, error) {
+        var replies []streamReply
+        err := c.update(func(k *keyspace) error {
+            replies = replies[:0]
+            now := nowMs()
+            for i, key := range x.keys {
+                last, ok, err := k.group(key, x.group)
+                if err != nil {
+                    return err
+                }
+                if !ok {
+                    return replyError("NOGROUP No such key '" + string(key) + "' or consumer group '" + string(x.group) + "' in XREADGROUP with GROUP option")
+                }
+                if _, err := k.touchConsumer(key, x.group, x.consumer); err != nil {
+                    return err
+                }
+                if after[i] != nil {
+                    entries := []streamEntry{}
+                    start, ok := after[i].next()
+                    if ok {
+                        var ferr error
+                        err = k.pendingRange(key, x.group, start, maxStreamID, func(p *pendingEntry) bool {
+                            if string(p.consumer) != string(x.consumer) {
+                                return true
+                            }
+                            var fields [][]byte
+                            if fields, ferr = k.entry(key, p.id); ferr != nil {
+                                return false
+                            }
+                            entries = append(entries, streamEntry{id: p.id, fields: fields})
+                            return x.count == 0 || int64(len(entries)) < x.count
+                        })
+                        if err == nil {
+                            err = ferr
+                        }
+                    }
+                    if err != nil {
+                        return err
+                    }
+                    replies = append(replies, streamReply{key: key, entries: entries})
+                    continue
+                }
+                entries, err := k.entriesAfter(key, last, x.count)
+                if err != nil {
+                    return err
+                }
+                if len(entries) == 0 {
+                    continue
+                }
+                for _, e := range entries {
+                    if x.noAck {
+                        continue
+                    }
+                    p := &pendingEntry{id: e.id, consumer: x.consumer, delivered: now, count: 1}
+                    if err := k.putPending(key, x.group, p); err != nil {
+                        return err
+                    }
+                }
+                if err := k.setGroup(key, x.group, entries[len(entries)-1].id); err != nil {
+                    return err
+                }
+                replies = append(replies, streamReply{key: key, entries: entries})
+            }
+            return nil
+        })
+        return replies, err
+    }
+    replies, err := read()
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case len(replies) > 0:
+        writeStreams(c, replies)
+    case !x.block || !c.block(x.keys, x.timeout, true, func() bool {
+        replies, err := read()
+        if err != nil {
+            writeError(c.conn, err)
+            return true
+        }
+        if len(replies) == 0 {
+            return false
+        }
+        writeStreams(c, replies)
+        return true
+    }):
+        c.conn.WriteArray(-1) // null array
+    }
+}
+
+// cmdXGroup implements XGROUP CREATE key group id|$ [MKSTREAM], XGROUP SETID
+// key group id|$, XGROUP DESTROY key group, XGROUP CREATECONSUMER key group
+// consumer and XGROUP DELCONSUMER key group consumer.
+func cmdXGroup(c *client, args [][]byte) {
+    sub := strings.ToLower(string(args[1]))
+    switch {
+    case sub == "create" && (len(args) == 5 || len(args) == 6):
+    case sub == "setid" && len(args) == 5:
+    case sub == "destroy" && len(args) == 4:
+    case sub == "createconsumer" && len(args) == 5:
+    case sub == "delconsumer" && len(args) == 5:
+    default:
+        writeError(c.conn, replyError("ERR unknown subcommand or wrong number of arguments for '"+sub+"'"))
+        return
+    }
+    key, group := args[2], args[3]
+    mkStream := false
+    if len(args) == 6 {
+        if strings.ToLower(string(args[5])) != "mkstream" {
+            writeError(c.conn, errSyntax)
+            return
+        }
+        mkStream = true
+    }
+    var id *streamID // nil for $
+    if (sub == "create" || sub == "setid") && string(args[4]) != "$" {
+        parsed, err := parseStreamID(args[4], 0)
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+        id = &parsed
+    }
+    var n int64
+    err := c.update(func(k *keyspace) error {
+        m, err := k.streamMeta(key)
+        if err != nil {
+            return err
+        }
+        if m == nil {
+            if !mkStream {
+                return errNoStream
+            }
+            if m, err = k.openStream(key); err != nil {
+                return err
+            }
+        }
+        last := m.last
+        if id != nil {
+            last = *id
+        }
+        _, exists, err := k.group(key, group)
+        if err != nil {
+            return err
+        }
+        if !exists && sub != "create" && sub != "destroy" {
+            return replyError("NOGROUP No such consumer group '" + string(group) + "' for key name '" + string(key) + "'")
+        }
+        switch sub {
+        case "create":
+            if exists {
+                return replyError("BUSYGROUP Consumer Group name already exists")
+            }
+            k.notify(notifyStream, "xgroup-create", key)
+            return k.setGroup(key, group, last)
+        case "setid":
+            k.notify(notifyStream, "xgroup-setid", key)
+            return k.setGroup(key, group, last)
+        case "destroy":
+            if !exists {
+                return nil
+            }
+            n = 1
+            k.notify(notifyStream, "xgroup-destroy", key)
+            return k.dropGroup(key, group)
+        case "createconsumer":
+            created, err := k.touchConsumer(key, group, args[4])
+            if created {
+                n = 1
+            }
+            return err
+        default:
+            k.notify(notifyStream, "xgroup-delconsumer", key)
+            n, err = k.dropConsumer(key, group, args[4])
+            return err
+        }
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case sub == "create" || sub == "setid":
+        c.conn.WriteString("OK")
+    default:
+        c.conn.WriteInt64(n)
+    }
+}
+
+// parseStreamIDs parses the ids args.
+func parseStreamIDs(args [][]byte) ([]streamID, error) {
+    ids := make([]streamID, len(args))
+    for i, arg := range args {
+        id, err := parseStreamID(arg, 0)
+        if err != nil {
+            return nil, err
+        }
+        ids[i] = id
+    }
+    return ids, nil
+}
+
+// cmdXAck implements XACK key group id [id ...].
+func cmdXAck(c *client, args [][]byte) {
+    ids, err := parseStreamIDs(args[3:])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var n int64
+    err = c.update(func(k *keyspace) error {
+        n = 0
+        _, ok, err := k.group(args[1], args[2])
+        if err != nil || !ok {
+            return err
+        }
+        for _, id := range ids {
+            p, err := k.pending(args[1], args[2], id)
+            if err != nil {
+                return err
+            }
+            if p == nil {
+                continue
+            }
+            if err := k.delPending(args[1], args[2], id); err != nil {
+                return err
+            }
+            n++
+        }
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+
+// cmdXPending implements XPENDING key group, which sums up the pending
+// entries of the group, and XPENDING key group [IDLE min-idle-time] start
+// end count [consumer], which lists them.
+func cmdXPending(c *client, args [][]byte) {
+    key, group := args[1], args[2]
+    summary := len(args) == 3
+    var (
+        minIdle, n int64
+        start, end streamID
+        ok1, ok2   bool
+        consumer   []byte
+        err        error
+    )
+    if rest := args[3:]; !summary {
+        if len(rest) > 2 && strings.ToLower(string(rest[0])) == "idle" {
+            if minIdle, err = parseInt(rest[1]); err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            rest = rest[2:]
+        }
+        if len(rest) != 3 && len(rest) != 4 {
+            writeError(c.conn, errSyntax)
+            return
+        }
+        if start, ok1, err = parseRangeID(rest[0], false); err == nil {
+            end, ok2, err = parseRangeID(rest[1], true)
+        }
+        if err == nil {
+            n, err = parseInt(rest[2])
+        }
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+        if len(rest) == 4 {
+            consumer = rest[3]
+        }
+    }
+    var (
+        pending     []*pendingEntry
+        consumers   = make(map[string]int64)
+        first, last *pendingEntry
+    )
+    err = c.view(func(k *keyspace) error {
+        _, ok, err := k.group(key, group)
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return replyError("NOGROUP No such key '" + string(key) + "' or consumer group '" + string(group) + "'")
+        }
+        if summary {
+            return k.pendingRange(key, group, streamID{}, maxStreamID, func(p *pendingEntry) bool {
+                if first == nil {
+                    first = p
+                }
+                last = p
+                consumers[string(p.consumer)]++
+                return true
+            })
+        }
+        if !ok1 || !ok2 || n <= 0 {
+            return nil
+        }
+        now := nowMs()
+        return k.pendingRange(key, group, start, end, func(p *pendingEntry) bool {
+            if consumer != nil && string(p.consumer) != string(consumer) || now-p.delivered < minIdle {
+                return true
+            }
+            pending = append(pending, p)
+            return int64(len(pending)) < n
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    if summary {
+        c.conn.WriteArray(4)
+        if first == nil {
+            c.conn.WriteInt(0)
+            c.conn.WriteNull()
+            c.conn.WriteNull()
+            c.conn.WriteArray(-1) // null array
+            return
+        }
+        var total int64
+        names := make([]string, 0, len(consumers))
+        for name, count := range consumers {
+            names = append(names, name)
+            total += count
+        }
+        sort.Strings(names)
+        c.conn.WriteInt64(total)
+        c.conn.WriteBulkString(first.id.String())
+        c.conn.WriteBulkString(last.id.String())
+        c.conn.WriteArray(len(names))
+        for _, name := range names {
+            c.conn.WriteArray(2)
+            c.conn.WriteBulkString(name)
+            c.conn.WriteBulkString(strconv.FormatInt(consumers[name], 10))
+        }
+        return
+    }
+    now := nowMs()
+    c.conn.WriteArray(len(pending))
+    for _, p := range pending {
+        c.conn.WriteArray(4)
+        c.conn.WriteBulkString(p.id.String())
+        c.conn.WriteBulk(p.consumer)
+        c.conn.WriteInt64(now - p.delivered)
+        c.conn.WriteInt64(p.count)
+    }
+}
+
+// cmdXClaim implements XCLAIM key group consumer min-idle-time id [id ...]
+// [IDLE ms] [TIME unix-ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id].
+// Pending entries deleted from the stream are dropped instead of claimed.
+func cmdXClaim(c *client, args [][]byte) {
+    key, group, consumer := args[1], args[2], args[3]
+    minIdle, err := parseInt(args[4])
+    if err != nil {
+        writeError(c.conn, replyError("ERR Invalid min-idle-time argument for XCLAIM"))
+        return
+    }
+    var (
+        ids           []streamID
+        delivered     = int64(-1)
+        retries       = int64(-1)
+        force, justID bool
+        lastID        *streamID
+        i             = 5
+    )
+    for ; i < len(args); i++ {
+        id, err := parseStreamID(args[i], 0)
+        if err != nil {
+            break
+        }
+        ids = append(ids, id)
+    }
+    now := nowMs()
+    for ; i < len(args); i++ {
+        opt := strings.ToLower(string(args[i]))
+        switch opt {
+        case "force":
+            force = true
+            continue
+        case "justid":
+            justID = true
+            continue
+        case "idle", "time", "retrycount", "lastid":
+        default:
+            writeError(c.conn, replyError("ERR Unrecognized XCLAIM option '"+string(args[i])+"'"))
+            return
+        }
+        if i+1 >= len(args) {
+            writeError(c.conn, errSyntax)
+            return
+        }
+        i++
+        if opt == "lastid" {
+            id, err := parseStreamID(args[i], 0)
+            if err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            lastID = &id
+            continue
+        }
+        v, err := parseInt(args[i])
+        if err != nil {
+            writeError(c.conn, err)
+            return
+        }
+        switch opt {
+        case "idle":
+            delivered = now - v
+        case "time":
+            delivered = v
+        default:
+            retries = v
+        }
+    }
+    if delivered < 0 || delivered > now {
+        delivered = now
+    }
+    var claimed []streamEntry
+    err = c.update(func(k *keyspace) error {
+        claimed = claimed[:0]
+        last, ok, err := k.group(key, group)
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return replyError("NOGROUP No such key '" + string(key) + "' or consumer group '" + string(group) + "' in XCLAIM")
+        }
+        if lastID != nil && last.less(*lastID) {
+            if err := k.setGroup(key, group, *lastID); err != nil {
+                return err
+            }
+        }
+        for _, id := range ids {
+            p, err := k.pending(key, group, id)
+            if err != nil {
+                return err
+            }
+            fields, err := k.entry(key, id)
+            if err != nil {
+                return err
+            }
+            switch {
+            case p == nil && (!force || fields == nil):
+                continue
+            case p == nil:
+                p = &pendingEntry{id: id}
+            case fields == nil:
+                if err := k.delPending(key, group, id); err != nil {
+                    return err
+                }
+                continue
+            case minIdle > 0 && now-p.delivered < minIdle:
+                continue
+            }
+            p.consumer, p.delivered = consumer, delivered
+            if retries >= 0 {
+                p.count = retries
+            } else if !justID {
+                p.count++
+            }
+            if err := k.putPending(key, group, p); err != nil {
+                return err
+            }
+            claimed = append(claimed, streamEntry{id: id, fields: fields})
+        }
+        if _, err := k.touchConsumer(key, group, consumer); err != nil {
+            return err
+        }
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    if !justID {
+        writeEntries(c.conn, claimed)
+        return
+    }
+    c.conn.WriteArray(len(claimed))
+    for _, e := range claimed {
+        c.conn.WriteBulkString(e.id.String())
+    }
+}
@@ -0,0 +1,463 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// getString returns the value of the string key, or nil when it does not
+// exist.
+func (k *keyspace) getString(key []byte) ([]byte, error) {
+    t, _, err := k.meta(key)
+    if err != nil || t == typeNone {
+        return nil, err
+    }
+    if t != typeString {
+        return nil, errWrongType
+    }
+    value, err := k.main.Get(key)
+    if err == store.ErrNotFound {
+        return nil, nil
+    }
+    return value, err
+}
+
+// incrBy adds delta to the integer held by key, keeping its ttl.
+func (k *keyspace) incrBy(key []byte, delta int64) (int64, error) {
+    value, err := k.getString(key)
+    if err != nil {
+        return 0, err
+    }
+    var n int64
+    if value == nil {
+        if err := k.clearStale(key); err != nil {
+            return 0, err
+        }
+    } else if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+        return 0, errNotInteger
+    }
+    if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+        return 0, errOverflow
+    }
+    n += delta
+    return n, k.main.PutKeepTTL(key, strconv.AppendInt(nil, n, 10))
+}
+
+// expireIn converts the expire argument n, counted in unit, to a ttl. With
+// at, n is a unix time. It fails when n does not fit a time.Duration.
+func expireIn(n int64, unit time.Duration, at bool) (time.Duration, bool) {
+    if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+        return 0, false
+    }
+    d := time.Duration(n) * unit
+    if at {
+        return time.Until(time.Unix(0, 0).Add(d)), true
+    }
+    return d, true
+}
+
+func cmdGet(c *client, args [][]byte) {
+    var value []byte
+    err := c.view(func(k *keyspace) (err error) {
+        value, err = k.getString(args[1])
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case value == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(value)
+    }
+}
+
+// cmdSet implements SET key value [NX|XX] [GET] [EX|PX|EXAT|PXAT n|KEEPTTL].
+func cmdSet(c *client, args [][]byte) {
+    var (
+        nx, xx, get, keepTTL, expires bool
+        ttl                           time.Duration
+    )
+    for i := 3; i < len(args); i++ {
+        switch opt := strings.ToLower(string(args[i])); opt {
+        case "nx":
+            nx = true
+        case "xx":
+            xx = true
+        case "get":
+            get = true
+        case "keepttl":
+            keepTTL = true
+        case "ex", "px", "exat", "pxat":
+            if expires || i+1 == len(args) {
+                writeError(c.conn, errSyntax)
+                return
+            }
+            n, err := parseInt(args[i+1])
+            if err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            unit := time.Second
+            if opt[0] == 'p' {
+                unit = time.Millisecond
+            }
+            var ok bool
+            if ttl, ok = expireIn(n, unit, len(opt) == 4); !ok || n <= 0 {
+                writeError(c.conn, replyError("ERR invalid expire time in 'set' command"))
+                return
+            }
+            expires = true
+            i++
+        default:
+            writeError(c.conn, errSyntax)
+            return
+        }
+    }
+    if (nx && xx) || (keepTTL && expires) {
+        writeError(c.conn, errSyntax)
+        return
+    }
+    key, value := args[1], args[2]
+    var (
+        old []byte
+        set bool
+    )
+    err := c.update(func(k *keyspace) error {
+        old, set = nil, false
+        t, _, err := k.meta(key)
+        if err != nil {
+            return err
+        }
+        exists := t != typeNone
+        if get && exists {
+            if t != typeString {
+                return errWrongType
+            }
+            if old, err = k.main.Get(key); err != nil {
+                return err
+            }
+        }
+        if (nx && exists) || (xx && !exists) {
+            return nil
+        }
+        set = true
+        if err := k.reuse(key, t); err != nil {
+            return err
+        }
+        switch {
+        case keepTTL:
+            k.notify(notifyString, "set", key)
+            return k.main.PutKeepTTL(key, value)
+        case expires && ttl <= 0:
+            // an expire time in the past leaves nothing to set
+            if exists {
+                k.notify(notifyGeneric, "del", key)
+            }
+            return k.main.Del(key)
+        case expires:
+            k.notify(notifyString, "set", key)
+            k.notify(notifyGeneric, "expire", key)
+            return k.main.PutWithTTL(key, value, ttl)
+        }
+        k.notify(notifyString, "set", key)
+        return k.main.Put(key, value)
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case get && old != nil:
+        c.conn.WriteBulk(old)
+    case get || !set:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteString("OK")
+    }
+}
+func cmdSetNX(c *client, args [][]byte) {
+    var ok bool
+    err := c.update(func(k *keyspace) error {
+        t, _, err := k.meta(args[1])
+        if ok = err == nil && t == typeNone; !ok {
+            return err
+        }
+        k.notify(notifyString, "set", args[1])
+        return k.putString(args[1], args[2])
+    })
+    writeBool(c, ok, err)
+}
+func cmdIncr(c *client, args [][]byte) {
+    delta, event := int64(1), "incrby"
+    if strings.ToLower(string(args[0])) == "decr" {
+        delta, event = -1, "decrby"
+    }
+    writeIncr(c, args[1], delta, event)
+}
+
+// cmdIncrBy also serves DECRBY.
+func cmdIncrBy(c *client, args [][]byte) {
+    delta, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    event := "incrby"
+    if strings.ToLower(string(args[0])) == "decrby" {
+        if delta == math.MinInt64 {
+            writeError(c.conn, errOverflow)
+            return
+        }
+        delta, event = -delta, "decrby"
+    }
+    writeIncr(c, args[1], delta, event)
+}
+func writeIncr(c *client, key []byte, delta int64, event string) {
+    var n int64
+    err := c.update(func(k *keyspace) (err error) {
+        if n, err = k.incrBy(key, delta); err != nil {
+            return err
+        }
+        k.notify(notifyString, event, key)
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
+func cmdIncrByFloat(c *client, args [][]byte) {
+    delta, err := strconv.ParseFloat(string(args[2]), 64)
+    if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+        writeError(c.conn, errNotFloat)
+        return
+    }
+    var value []byte
+    err = c.update(func(k *keyspace) error {
+        old, err := k.getString(args[1])
+        if err != nil {
+            return err
+        }
+        var f float64
+        if old == nil {
+            if err := k.clearStale(args[1]); err != nil {
+                return err
+            }
+        } else if f, err = strconv.ParseFloat(string(old), 64); err != nil {
+            return errNotFloat
+        }
+        f += delta
+        if math.IsNaN(f) || math.IsInf(f, 0) {
+            return replyError("ERR increment would produce NaN or Infinity")
+        }
+        value = strconv.AppendFloat(nil, f, 'f', -1, 64)
+        k.notify(notifyString, "incrbyfloat", args[1])
+        return k.main.PutKeepTTL(args[1], value)
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteBulk(value)
+    }
+}
+func cmdMGet(c *client, args [][]byte) {
+    values := make([][]byte, len(args)-1)
+    err := c.view(func(k *keyspace) error {
+        for i, key := range args[1:] {
+            value, err := k.getString(key)
+            if err == errWrongType {
+                value, err = nil, nil
+            }
+            if err != nil {
+                return err
+            }
+            values[i] = value
+        }
+        return nil
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        writeBulks(c.conn, values)
+    }
+}
+
+// cmdMSet also serves MSETNX, which sets nothing when any of the keys
+// exists.
+func cmdMSet(c *client, args [][]byte) {
+    if len(args)%2 == 0 {
+        writeArgError(c.conn, args[0])
+        return
+    }
+    nx := strings.ToLower(string(args[0])) == "msetnx"
+    var ok bool
+    err := c.update(func(k *keyspace) error {
+        ok = false
+        for i := 1; nx && i < len(args); i += 2 {
+            if t, _, err := k.meta(args[i]); err != nil || t != typeNone {
+                return err
+            }
+        }
+        for i := 1; i < len(args); i += 2 {
+            if err := k.putString(args[i], args[i+1]); err != nil {
+                return err
+            }
+            k.notify(notifyString, "set", args[i])
+        }
+        ok = true
+        return nil
+    })
+    if !nx && err == nil {
+        c.conn.WriteString("OK")
+        return
+    }
+    writeBool(c, ok, err)
+}
+
+// cmdGetSet also serves GETDEL, which deletes the key instead of setting it.
+func cmdGetSet(c *client, args [][]byte) {
+    var old []byte
+    err := c.update(func(k *keyspace) (err error) {
+        if old, err = k.getString(args[1]); err != nil {
+            return err
+        }
+        if len(args) == 2 {
+            if old != nil {
+                k.notify(notifyGeneric, "del", args[1])
+            }
+            _, err = k.remove(args[1])
+            return err
+        }
+        k.notify(notifyString, "set", args[1])
+        return k.putString(args[1], args[2])
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case old == nil:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(old)
+    }
+}
+func cmdAppend(c *client, args [][]byte) {
+    var n int
+    err := c.update(func(k *keyspace) error {
+        value, err := k.getString(args[1])
+        if err != nil {
+            return err
+        }
+        if value == nil {
+            if err := k.clearStale(args[1]); err != nil {
+                return err
+            }
+        }
+        value = append(value, args[2]...)
+        n = len(value)
+        k.notify(notifyString, "append", args[1])
+        return k.main.PutKeepTTL(args[1], value)
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt(n)
+    }
+}
+func cmdStrLen(c *client, args [][]byte) {
+    var value []byte
+    err := c.view(func(k *keyspace) (err error) {
+        value, err = k.getString(args[1])
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt(len(value))
+    }
+}
+func cmdGetRange(c *client, args [][]byte) {
+    start, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    end, err := parseInt(args[3])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var value []byte
+    err = c.view(func(k *keyspace) (err error) {
+        value, err = k.getString(args[1])
+        return err
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    n := int64(len(value))
+    if start < 0 {
+        start += n
+    }
+    if end < 0 {
+        end += n
+    }
+    if start < 0 {
+        start = 0
+    }
+    if end >= n {
+        end = n - 1
+    }
+    if start > end || n == 0 {
+        c.conn.WriteBulk(nil)
+        return
+    }
+    c.conn.WriteBulk(value[start : end+1])
+}
+
+// maxString is the largest string SETRANGE makes, as in redis.
+const maxString = 512 << 20
+
+func cmdSetRange(c *client, args [][]byte) {
+    offset, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    if offset < 0 || offset > maxString-int64(len(args[3])) {
+        writeError(c.conn, replyError("ERR offset is out of range"))
+        return
+    }
+    var n int
+    err = c.update(func(k *keyspace) error {
+        value, err := k.getString(args[1])
+        if err != nil {
+            return err
+        }
+        n = len(value)
+        if len(args[3]) == 0 {
+            // nothing to write, and no key to create
+            return nil
+        }
+        if value == nil {
+            if err := k.clearStale(args[1]); err != nil {
+                return err
+            }
+        }
+        if end := int(offset) + len(args[3]); end > len(value) {
+            value = append(value, make([]byte, end-len(value))...)
+        }
+        copy(value[offset:], args[3])
+        n = len(value)
+        k.notify(notifyString, "setrange", args[1])
+        return k.main.PutKeepTTL(args[1], value)
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt(n)
+    }
+}
@@ -0,0 +1,503 @@
+package store_redis
+
+import (
+    "github.com/DGHeroin/vault/store"
+    "github.com/DGHeroin/vault/store/tuple"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// zscore returns the score of member, and whether it is in the sorted set.
+func (k *keyspace) zscore(key, member []byte) (float64, bool, error) {
+    data, err := k.aux.Get(pack(key, "z", member))
+    if err == store.ErrNotFound {
+        return 0, false, nil
+    } else if err != nil {
+        return 0, false, err
+    }
+    t, err := tuple.Unpack(data)
+    if err != nil || len(t) != 1 {
+        return 0, false, errCorrupt
+    }
+    score, ok := t[0].(float64)
+    if !ok {
+        return 0, false, errCorrupt
+    }
+    return score, true, nil
+}
+
+// zput sets the score of member, replacing old when it was in the set.
+func (k *keyspace) zput(key, member []byte, score, old float64, exists bool) error {
+    if exists {
+        if err := k.aux.Del(pack(key, "Z", old, member)); err != nil {
+            return err
+        }
+    }
+    if err := k.aux.Put(pack(key, "z", member), pack(score)); err != nil {
+        return err
+    }
+    return k.aux.Put(pack(key, "Z", score, member), nil)
+}
+
+// zwalk walks the members of the sorted set between the score index keys
+// start and limit.
+func (k *keyspace) zwalk(key, start, limit []byte, reverse bool, fn func(score float64, member []byte) bool) error {
+    var perr error
+    err := k.aux.Range(start, limit, func(aux []byte, _ []byte) bool {
+        t, err := tuple.Unpack(aux)
+        if err != nil || len(t) != 4 {
+            perr = errCorrupt
+            return false
+        }
+        score, _ := t[2].(float64)
+        member, _ := t[3].([]byte)
+        return fn(score, member)
+    }, &store.RangeOptions{Reverse: reverse, KeysOnly: true})
+    if err != nil {
+        return err
+    }
+    return perr
+}
+
+// scoreRange returns the score index keys bounding the scores from min to
+// max of the sorted set key.
+func scoreRange(key []byte, min float64, minEx bool, max float64, maxEx bool) ([]byte, []byte) {
+    start, limit := pack(key, "Z", min), pack(key, "Z", max)
+    if minEx {
+        start = append(start, 0xff)
+    }
+    if !maxEx {
+        limit = append(limit, 0xff)
+    }
+    return start, limit
+}
+func parseScore(arg []byte) (float64, error) {
+    f, err := strconv.ParseFloat(string(arg), 64)
+    if err != nil || math.IsNaN(f) {
+        return 0, errNotFloat
+    }
+    return f, nil
+}
+
+// parseBound parses a score bound of ZRANGEBYSCORE, exclusive when it starts
+// with '('.
+func parseBound(arg []byte) (float64, bool, error) {
+    ex := len(arg) > 0 && arg[0] == '('
+    if ex {
+        arg = arg[1:]
+    }
+    f, err := strconv.ParseFloat(string(arg), 64)
+    if err != nil || math.IsNaN(f) {
+        return 0, false, replyError("ERR min or max is not a float")
+    }
+    return f, ex, nil
+}
+func formatScore(f float64) []byte {
+    switch {
+    case math.IsInf(f, 1):
+        return []byte("inf")
+    case math.IsInf(f, -1):
+        return []byte("-inf")
+    case f == math.Trunc(f) && math.Abs(f) < 1e17:
+        return strconv.AppendFloat(nil, f, 'f', -1, 64)
+    }
+    return strconv.AppendFloat(nil, f, 'g', -1, 64)
+}
+
+func cmdZAdd(c *client, args [][]byte) {
+    var nx, xx, gt, lt, ch, incr bool
+    i := 2
+flags:
+    for ; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "nx":
+            nx = true
+        case "xx":
+            xx = true
+        case "gt":
+            gt = true
+        case "lt":
+            lt = true
+        case "ch":
+            ch = true
+        case "incr":
+            incr = true
+        default:
+            break flags
+        }
+    }
+    pairs := args[i:]
+    switch {
+    case len(pairs) == 0 || len(pairs)%2 != 0:
+        writeError(c.conn, errSyntax)
+        return
+    case nx && xx:
+        writeError(c.conn, replyError("ERR XX and NX options at the same time are not compatible"))
+        return
+    case (gt && lt) || (nx && (gt || lt)):
+        writeError(c.conn, replyError("ERR GT, LT, and/or NX options at the same time are not compatible"))
+        return
+    case incr && len(pairs) != 2:
+        writeError(c.conn, replyError("ERR INCR option supports a single increment-element pair"))
+        return
+    }
+    scores := make([]float64, len(pairs)/2)
+    for j := range scores {
+        var err error
+        if scores[j], err = parseScore(pairs[2*j]); err != nil {
+            writeError(c.conn, err)
+            return
+        }
+    }
+    var (
+        changed int64
+        result  float64
+        skipped bool
+    )
+    err := c.update(func(k *keyspace) error {
+        changed, skipped = 0, false
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil {
+            return err
+        }
+        if meta == nil {
+            if xx {
+                skipped = true
+                return nil
+            }
+            meta = tuple.Tuple{typeZSet, int64(0)}
+            if err := k.create(args[1], meta); err != nil {
+                return err
+            }
+        }
+        added := int64(0)
+        for j, score := range scores {
+            member := pairs[2*j+1]
+            old, exists, err := k.zscore(args[1], member)
+            if err != nil {
+                return err
+            }
+            if incr {
+                score += old
+                if math.IsNaN(score) {
+                    return replyError("ERR resulting score is not a number (NaN)")
+                }
+            }
+            if (nx && exists) || (xx && !exists) || (exists && ((gt && score <= old) || (lt && score >= old))) {
+                skipped = true
+                continue
+            }
+            result = score
+            if exists && score == old {
+                continue
+            }
+            if err := k.zput(args[1], member, score, old, exists); err != nil {
+                return err
+            }
+            changed++
+            if !exists {
+                added++
+            }
+        }
+        if changed > 0 {
+            event := "zadd"
+            if incr {
+                event = "zincr"
+            }
+            k.notify(notifyZSet, event, args[1])
+        }
+        if !ch {
+            changed = added
+        }
+        if n := count(meta, 1) + added; n > 0 {
+            return k.setMeta(args[1], tuple.Tuple{typeZSet, n})
+        }
+        return k.drop(args[1])
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case incr && skipped:
+        c.conn.WriteNull()
+    case incr:
+        c.conn.WriteBulk(formatScore(result))
+    default:
+        c.conn.WriteInt64(changed)
+    }
+}
+func cmdZIncrBy(c *client, args [][]byte) {
+    delta, err := parseScore(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var score float64
+    err = c.update(func(k *keyspace) error {
+        meta, err := k.open(args[1], tuple.Tuple{typeZSet, int64(0)})
+        if err != nil {
+            return err
+        }
+        old, exists, err := k.zscore(args[1], args[3])
+        if err != nil {
+            return err
+        }
+        if score = old + delta; math.IsNaN(score) {
+            return replyError("ERR resulting score is not a number (NaN)")
+        }
+        k.notify(notifyZSet, "zincr", args[1])
+        if err := k.zput(args[1], args[3], score, old, exists); err != nil || exists {
+            return err
+        }
+        return k.setMeta(args[1], tuple.Tuple{typeZSet, count(meta, 1) + 1})
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteBulk(formatScore(score))
+    }
+}
+func cmdZRem(c *client, args [][]byte) {
+    var removed int64
+    err := c.update(func(k *keyspace) error {
+        removed = 0
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        for _, member := range args[2:] {
+            score, exists, err := k.zscore(args[1], member)
+            if err != nil {
+                return err
+            }
+            if !exists {
+                continue
+            }
+            if err := k.aux.Del(pack(args[1], "z", member)); err != nil {
+                return err
+            }
+            if err := k.aux.Del(pack(args[1], "Z", score, member)); err != nil {
+                return err
+            }
+            removed++
+        }
+        if removed > 0 {
+            k.notify(notifyZSet, "zrem", args[1])
+        }
+        if n := count(meta, 1) - removed; n > 0 {
+            return k.setMeta(args[1], tuple.Tuple{typeZSet, n})
+        }
+        return k.drop(args[1])
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(removed)
+    }
+}
+func cmdZScore(c *client, args [][]byte) {
+    var (
+        score  float64
+        exists bool
+    )
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        score, exists, err = k.zscore(args[1], args[2])
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case !exists:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteBulk(formatScore(score))
+    }
+}
+func cmdZCard(c *client, args [][]byte) {
+    writeCount(c, args[1], typeZSet)
+}
+
+// cmdZRank also serves ZREVRANK.
+func cmdZRank(c *client, args [][]byte) {
+    rank := int64(-1)
+    err := c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        score, exists, err := k.zscore(args[1], args[2])
+        if err != nil || !exists {
+            return err
+        }
+        rank = 0
+        err = k.zwalk(args[1], pack(args[1], "Z"), pack(args[1], "Z", score, args[2]), false, func(float64, []byte) bool {
+            rank++
+            return true
+        })
+        if strings.ToLower(string(args[0])) == "zrevrank" {
+            rank = count(meta, 1) - 1 - rank
+        }
+        return err
+    })
+    switch {
+    case err != nil:
+        writeError(c.conn, err)
+    case rank < 0:
+        c.conn.WriteNull()
+    default:
+        c.conn.WriteInt64(rank)
+    }
+}
+
+// cmdZRange also serves ZREVRANGE.
+func cmdZRange(c *client, args [][]byte) {
+    reverse := strings.ToLower(string(args[0])) == "zrevrange"
+    withScores := len(args) == 5 && strings.ToLower(string(args[4])) == "withscores"
+    if len(args) > 5 || (len(args) == 5 && !withScores) {
+        writeError(c.conn, errSyntax)
+        return
+    }
+    start, err := parseInt(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    stop, err := parseInt(args[3])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    values := [][]byte{}
+    err = c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        first, last, ok := listRange(0, count(meta, 1), start, stop)
+        if !ok {
+            return nil
+        }
+        i := int64(0)
+        start, limit, _ := tuple.Range(tuple.Tuple{args[1], "Z"})
+        return k.zwalk(args[1], start, limit, reverse, func(score float64, member []byte) bool {
+            if i >= first {
+                values = append(values, member)
+                if withScores {
+                    values = append(values, formatScore(score))
+                }
+            }
+            i++
+            return i <= last
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeBulks(c.conn, values)
+}
+
+// cmdZRangeByScore also serves ZREVRANGEBYSCORE, which takes max before min.
+func cmdZRangeByScore(c *client, args [][]byte) {
+    reverse := strings.ToLower(string(args[0])) == "zrevrangebyscore"
+    minArg, maxArg := args[2], args[3]
+    if reverse {
+        minArg, maxArg = maxArg, minArg
+    }
+    min, minEx, err := parseBound(minArg)
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    max, maxEx, err := parseBound(maxArg)
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var (
+        withScores bool
+        offset     int64
+        limit      = int64(-1)
+    )
+    for i := 4; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "withscores":
+            withScores = true
+        case "limit":
+            if i+2 >= len(args) {
+                writeError(c.conn, errSyntax)
+                return
+            }
+            if offset, err = parseInt(args[i+1]); err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            if limit, err = parseInt(args[i+2]); err != nil {
+                writeError(c.conn, err)
+                return
+            }
+            i += 2
+        default:
+            writeError(c.conn, errSyntax)
+            return
+        }
+    }
+    values := [][]byte{}
+    err = c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil || meta == nil || offset < 0 || limit == 0 {
+            return err
+        }
+        start, end := scoreRange(args[1], min, minEx, max, maxEx)
+        i, n := int64(0), int64(0)
+        return k.zwalk(args[1], start, end, reverse, func(score float64, member []byte) bool {
+            if i++; i <= offset {
+                return true
+            }
+            values = append(values, member)
+            if withScores {
+                values = append(values, formatScore(score))
+            }
+            n++
+            return limit < 0 || n < limit
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    writeBulks(c.conn, values)
+}
+func cmdZCount(c *client, args [][]byte) {
+    min, minEx, err := parseBound(args[2])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    max, maxEx, err := parseBound(args[3])
+    if err != nil {
+        writeError(c.conn, err)
+        return
+    }
+    var n int64
+    err = c.view(func(k *keyspace) error {
+        meta, err := k.lookup(args[1], typeZSet)
+        if err != nil || meta == nil {
+            return err
+        }
+        start, end := scoreRange(args[1], min, minEx, max, maxEx)
+        return k.zwalk(args[1], start, end, false, func(float64, []byte) bool {
+            n++
+            return true
+        })
+    })
+    if err != nil {
+        writeError(c.conn, err)
+    } else {
+        c.conn.WriteInt64(n)
+    }
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+    "bytes"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "math"
+    "strconv"
+)
+
+var (
+    ErrNotInteger = errors.New("store: value is not an integer")
+    ErrNotFloat   = errors.New("store: value is not a valid float")
+    ErrOverflow   = errors.New("store: increment would overflow")
+)
+
+// Counters are stored as decimal strings, so they stay readable through Get
+// and through the redis front-end. Increments keep the ttl of the key.
+
+func (s *Store) Incr(key []byte) (int64, error) {
+    return s.incrBy(nil, key, 1)
+}
+func (s *Store) IncrBy(key []byte, delta int64) (int64, error) {
+    return s.incrBy(nil, key, delta)
+}
+func (s *Store) IncrFloat(key []byte, delta float64) (float64, error) {
+    return s.incrFloat(nil, key, delta)
+}
+
+// CompareAndSwap replaces the value of key with value if it currently equals
+// old. A nil old only matches a missing key. Like Put, a successful swap
+// clears the ttl of key.
+func (s *Store) CompareAndSwap(key, old, value []byte) (bool, error) {
+    return s.compareAndSwap(nil, key, old, value)
+}
+
+// PutIfAbsent stores value under key unless the key already exists.
+func (s *Store) PutIfAbsent(key, value []byte) (bool, error) {
+    return s.compareAndSwap(nil, key, nil, value)
+}
+
+func (s *Store) incrBy(scope, key []byte, delta int64) (int64, error) {
+    var n int64
+    err := s.modify(scope, key, func(old []byte, exists bool) ([]byte, error) {
+        if exists {
+            v, err := strconv.ParseInt(string(old), 10, 64)
+            if err != nil {
+                return nil, ErrNotInteger
+            }
+            n = v
+        }
+        if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+            return nil, ErrOverflow
+        }
+        n += delta
+        return strconv.AppendInt(nil, n, 10), nil
+    })
+    return n, err
+}
+func (s *Store) incrFloat(scope, key []byte, delta float64) (float64, error) {
+    var f float64
+    err := s.modify(scope, key, func(old []byte, exists bool) ([]byte, error) {
+        if exists {
+            v, err := strconv.ParseFloat(string(old), 64)
+            if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+                return nil, ErrNotFloat
+            }
+            f = v
+        }
+        f += delta
+        if math.IsNaN(f) || math.IsInf(f, 0) {
+            return nil, ErrNotFloat
+        }
+        return strconv.AppendFloat(nil, f, 'f', -1, 64), nil
+    })
+    return f, err
+}
+
+func (s *Store) compareAndSwap(scope, key, old, value []byte) (bool, error) {
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return false, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    current, err := get(s.db, key)
+    if err != nil && err != ErrNotFound {
+        return false, err
+    }
+    if (old == nil) != (err == ErrNotFound) || !bytes.Equal(current, old) {
+        return false, nil
+    }
+    b := new(writeBatch)
+    b.put(key, value)
+    if err := s.writeLocked(b); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// modify replaces the value of key with the result of fn while holding the
+// write lock, keeping any ttl the key has.
+func (s *Store) modify(scope, key []byte, fn func(old []byte, exists bool) ([]byte, error)) error {
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    old, err := get(s.db, key)
+    if err != nil && err != ErrNotFound {
+        return err
+    }
+    exists := err == nil
+    value, err := fn(old, exists)
+    if err != nil {
+        return err
+    }
+    b := new(writeBatch)
+    if exists {
+        b.putKeepTTL(key, value)
+    } else {
+        b.put(key, value)
+    }
+    return s.writeLocked(b)
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+    "github.com/syndtr/goleveldb/leveldb"
+    "github.com/syndtr/goleveldb/leveldb/filter"
+    "github.com/syndtr/goleveldb/leveldb/iterator"
+    "github.com/syndtr/goleveldb/leveldb/opt"
+    "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type (
+    // Backend is the storage engine under a Store. Implementations must be
+    // safe for concurrent use and report missing keys with ErrNotFound.
+    Backend interface {
+        Get(key []byte) ([]byte, error)
+        Has(key []byte) (bool, error)
+        Put(key, value []byte) error
+        Delete(key []byte) error
+        // Write applies the batch atomically.
+        Write(batch *leveldb.Batch) error
+        // NewIterator walks the keys of r, or all keys when r is nil, in
+        // ascending order.
+        NewIterator(r *util.Range) iterator.Iterator
+        GetSnapshot() (BackendSnapshot, error)
+        CompactRange(r util.Range) error
+        Close() error
+    }
+    // BackendSnapshot is a read-only, point-in-time view of a Backend.
+    BackendSnapshot interface {
+        Get(key []byte) ([]byte, error)
+        Has(key []byte) (bool, error)
+        NewIterator(r *util.Range) iterator.Iterator
+        Release()
+    }
+)
+
+// OpenLevelDB opens the goleveldb database at path, the default Backend,
+// applying the leveldb settings of opts.
+func OpenLevelDB(path string, opts ...*Options) (Backend, error) {
+    o := &Options{}
+    if len(opts) > 0 && opts[0] != nil {
+        o = opts[0]
+    }
+    lo := &opt.Options{
+        BlockCacheCapacity:     o.BlockCacheCapacity,
+        WriteBuffer:            o.WriteBuffer,
+        OpenFilesCacheCapacity: o.OpenFilesCacheCapacity,
+        ErrorIfMissing:         o.ErrorIfMissing,
+        ReadOnly:               o.ReadOnly,
+    }
+    if o.BloomFilterBits > 0 {
+        lo.Filter = filter.NewBloomFilter(o.BloomFilterBits)
+    }
+    if o.DisableCompression {
+        lo.Compression = opt.NoCompression
+    }
+    db, err := leveldb.OpenFile(path, lo)
+    if err != nil {
+        return nil, err
+    }
+    return &levelDB{db: db, wo: &opt.WriteOptions{Sync: o.Sync}}, nil
+}
+
+type levelDB struct {
+    db *leveldb.DB
+    wo *opt.WriteOptions
+}
+
+func (l *levelDB) Get(key []byte) ([]byte, error) {
+    return l.db.Get(key, nil)
+}
+func (l *levelDB) Has(key []byte) (bool, error) {
+    return l.db.Has(key, nil)
+}
+func (l *levelDB) Put(key, value []byte) error {
+    return l.db.Put(key, value, l.wo)
+}
+func (l *levelDB) Delete(key []byte) error {
+    return l.db.Delete(key, l.wo)
+}
+func (l *levelDB) Write(batch *leveldb.Batch) error {
+    return l.db.Write(batch, l.wo)
+}
+func (l *levelDB) NewIterator(r *util.Range) iterator.Iterator {
+    return l.db.NewIterator(r, nil)
+}
+func (l *levelDB) GetSnapshot() (BackendSnapshot, error) {
+    snap, err := l.db.GetSnapshot()
+    if err != nil {
+        return nil, err
+    }
+    return &levelSnapshot{snap: snap}, nil
+}
+func (l *levelDB) CompactRange(r util.Range) error {
+    return l.db.CompactRange(r)
+}
+func (l *levelDB) Close() error {
+    return l.db.Close()
+}
+
+type levelSnapshot struct {
+    snap *leveldb.Snapshot
+}
+
+func (l *levelSnapshot) Get(key []byte) ([]byte, error) {
+    return l.snap.Get(key, nil)
+}
+func (l *levelSnapshot) Has(key []byte) (bool, error) {
+    return l.snap.Has(key, nil)
+}
+func (l *levelSnapshot) NewIterator(r *util.Range) iterator.Iterator {
+    return l.snap.NewIterator(r, nil)
+}
+func (l *levelSnapshot) Release() {
+    l.snap.Release()
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+    "bytes"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "strings"
+    "time"
+)
+
+var ErrInvalidBucket = errors.New("store: invalid bucket name")
+
+// Bucket data lives in the reserved keyspace under bucketPrefix + name + 0x00,
+// and every bucket ever opened is recorded under registryPrefix + name.
+var (
+    bucketPrefix   = []byte("\xff\xffb")
+    registryPrefix = []byte("\xff\xffB")
+)
+
+const dropBatch = 1024
+
+// Bucket is a namespaced view of a Store. Its keys are transparently
+// prefixed, so they never collide with the root keyspace or other buckets.
+type Bucket struct {
+    s     *Store
+    name  string
+    scope []byte
+}
+
+// Bucket opens the bucket called name, creating it if needed.
+func (s *Store) Bucket(name string) (*Bucket, error) {
+    if name == "" || strings.IndexByte(name, 0) >= 0 {
+        return nil, ErrInvalidBucket
+    }
+    key := append(copyBytes(registryPrefix), name...)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if ok, err := s.db.Has(key); err != nil {
+        return nil, err
+    } else if !ok && !s.readOnly {
+        b := new(writeBatch)
+        b.putRaw(key, nil)
+        if err := s.writeLocked(b); err != nil {
+            return nil, err
+        }
+    }
+    return &Bucket{s: s, name: name, scope: bucketScope(name)}, nil
+}
+
+func (s *Store) ListBuckets() ([]string, error) {
+    var names []string
+    it := s.db.NewIterator(util.BytesPrefix(registryPrefix))
+    defer it.Release()
+    for it.Next() {
+        names = append(names, string(it.Key()[len(registryPrefix):]))
+    }
+    return names, it.Error()
+}
+
+// DropBucket deletes the bucket and all of its keys, then compacts the range
+// they occupied.
+func (s *Store) DropBucket(name string) error {
+    if name == "" || strings.IndexByte(name, 0) >= 0 {
+        return ErrInvalidBucket
+    }
+    scope := bucketScope(name)
+    s.mu.Lock()
+    delete(s.indexes, string(scope))
+    s.mu.Unlock()
+    r := util.BytesPrefix(scope)
+    for _, drop := range []*util.Range{
+        r,
+        util.BytesPrefix(append(copyBytes(indexPrefix), indexSpace(scope)...)),
+        util.BytesPrefix(append(copyBytes(indexRegistryPrefix), indexSpace(scope)...)),
+    } {
+        for {
+            n, err := s.dropRange(drop, dropBatch)
+            if err != nil {
+                return err
+            }
+            if n < dropBatch {
+                break
+            }
+        }
+    }
+    b := new(writeBatch)
+    b.deleteRaw(append(copyBytes(registryPrefix), name...))
+    if err := s.write(b); err != nil {
+        return err
+    }
+    return s.db.CompactRange(*r)
+}
+
+func (s *Store) deleteRange(scope []byte, r *util.Range) error {
+    full := scopeRange(scope, r)
+    if full == nil {
+        return nil
+    }
+    for {
+        n, err := s.dropRange(full, dropBatch)
+        if err != nil {
+            return err
+        }
+        if n < dropBatch {
+            return s.db.CompactRange(*full)
+        }
+    }
+}
+
+// dropRange deletes up to n keys of r, together with the ttl of data keys.
+func (s *Store) dropRange(r *util.Range, n int) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.dropRangeLocked(r, n)
+}
+func (s *Store) dropRangeLocked(r *util.Range, n int) (int, error) {
+    b := new(writeBatch)
+    it := s.db.NewIterator(r)
+    defer it.Release()
+    count := 0
+    for count < n && it.Next() {
+        if key := copyBytes(it.Key()); isDataKey(key) {
+            b.del(key)
+        } else {
+            b.deleteRaw(key)
+        }
+        count++
+    }
+    if err := it.Error(); err != nil || count == 0 {
+        return 0, err
+    }
+    return count, s.writeLocked(b)
+}
+
+// clearRangeLocked deletes all keys of r. It is called with s.mu held.
+func (s *Store) clearRangeLocked(r *util.Range) error {
+    for {
+        n, err := s.dropRangeLocked(r, dropBatch)
+        if err != nil || n < dropBatch {
+            return err
+        }
+    }
+}
+
+func (b *Bucket) Name() string {
+    return b.name
+}
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+    return b.s.get(b.scope, key)
+}
+func (b *Bucket) Put(key, value []byte) error {
+    return b.s.batch(b.scope, func(w scopedBatch) {
+        w.Put(key, value)
+    })
+}
+func (b *Bucket) Del(key []byte) error {
+    return b.s.batch(b.scope, func(w scopedBatch) {
+        w.Delete(key)
+    })
+}
+func (b *Bucket) BatchPut(fn func(putter Putter)) error {
+    return b.s.batch(b.scope, func(w scopedBatch) {
+        fn(w)
+    })
+}
+func (b *Bucket) BatchDel(fn func(del Deleter)) error {
+    return b.s.batch(b.scope, func(w scopedBatch) {
+        fn(w)
+    })
+}
+func (b *Bucket) Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return iterate(b.s.db, b.scope, &util.Range{
+        Start: start,
+        Limit: limit,
+    }, rangeOptions(opts), fn)
+}
+func (b *Bucket) RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return iterate(b.s.db, b.scope, util.BytesPrefix(prefix), rangeOptions(opts), fn)
+}
+func (b *Bucket) DeleteRange(start, limit []byte) error {
+    return b.s.deleteRange(b.scope, &util.Range{Start: start, Limit: limit})
+}
+func (b *Bucket) PutWithTTL(key, value []byte, ttl time.Duration) error {
+    return b.s.putWithTTL(b.scope, key, value, ttl)
+}
+func (b *Bucket) Expire(key []byte, ttl time.Duration) error {
+    return b.s.expire(b.scope, key, ttl)
+}
+func (b *Bucket) TTL(key []byte) (time.Duration, error) {
+    return b.s.ttl(b.scope, key)
+}
+func (b *Bucket) Persist(key []byte) error {
+    return b.s.persist(b.scope, key)
+}
+func (b *Bucket) Incr(key []byte) (int64, error) {
+    return b.s.incrBy(b.scope, key, 1)
+}
+func (b *Bucket) IncrBy(key []byte, delta int64) (int64, error) {
+    return b.s.incrBy(b.scope, key, delta)
+}
+func (b *Bucket) IncrFloat(key []byte, delta float64) (float64, error) {
+    return b.s.incrFloat(b.scope, key, delta)
+}
+func (b *Bucket) CompareAndSwap(key, old, value []byte) (bool, error) {
+    return b.s.compareAndSwap(b.scope, key, old, value)
+}
+func (b *Bucket) PutIfAbsent(key, value []byte) (bool, error) {
+    return b.s.compareAndSwap(b.scope, key, nil, value)
+}
+func (b *Bucket) RegisterIndex(name string, fn IndexFunc) error {
+    return b.s.registerIndex(b.scope, name, fn)
+}
+func (b *Bucket) RebuildIndex(name string) error {
+    return b.s.rebuildIndex(b.scope, name)
+}
+func (b *Bucket) DropIndex(name string) error {
+    return b.s.dropIndex(b.scope, name)
+}
+func (b *Bucket) QueryIndex(name string, value []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return b.s.queryIndex(b.scope, name, value, fn, rangeOptions(opts))
+}
+func (b *Bucket) QueryIndexRange(name string, start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return b.s.queryIndexRange(b.scope, name, start, limit, fn, rangeOptions(opts))
+}
+func (b *Bucket) Watch(prefix []byte, opts ...*WatchOptions) *Watcher {
+    return b.s.watch(b.scope, prefix, opts)
+}
+
+func bucketScope(name string) []byte {
+    scope := make([]byte, 0, len(bucketPrefix)+len(name)+1)
+    scope = append(scope, bucketPrefix...)
+    scope = append(scope, name...)
+    return append(scope, 0)
+}
+
+// isDataKey reports whether key holds caller data, in the root keyspace or in
+// a bucket, rather than store metadata.
+func isDataKey(key []byte) bool {
+    return !isSysKey(key) || bytes.HasPrefix(key, bucketPrefix)
+}
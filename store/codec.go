@@ -0,0 +1,104 @@
+package store
+
+import (
+    "bytes"
+    "encoding"
+    "encoding/gob"
+    "encoding/json"
+    "fmt"
+    "github.com/vmihailenco/msgpack/v5"
+    "reflect"
+)
+
+// Codec turns the values of a Collection into bytes and back. Unmarshal is
+// handed a pointer to the value to fill.
+type Codec interface {
+    Marshal(v interface{}) ([]byte, error)
+    Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+    JSONCodec    Codec = jsonCodec{}
+    GobCodec     Codec = gobCodec{}
+    MsgpackCodec Codec = msgpackCodec{}
+    // BinaryCodec stores values that marshal themselves, either through
+    // encoding.BinaryMarshaler or protobuf-style Marshal/Unmarshal methods.
+    BinaryCodec Codec = binaryCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+    return json.Marshal(v)
+}
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+    return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+    return msgpack.Marshal(v)
+}
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+    return msgpack.Unmarshal(data, v)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+    if data, ok, err := marshalSelf(v); ok {
+        return data, err
+    }
+    // methods with a pointer receiver need an addressable copy
+    if rv := reflect.ValueOf(v); rv.IsValid() && rv.Kind() != reflect.Ptr {
+        p := reflect.New(rv.Type())
+        p.Elem().Set(rv)
+        if data, ok, err := marshalSelf(p.Interface()); ok {
+            return data, err
+        }
+    }
+    return nil, fmt.Errorf("store: %T does not marshal itself", v)
+}
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+    // v may point to a nil pointer, as for a Collection of *Message
+    rv := reflect.ValueOf(v)
+    for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+        switch m := rv.Interface().(type) {
+        case encoding.BinaryUnmarshaler:
+            return m.UnmarshalBinary(data)
+        case interface{ Unmarshal([]byte) error }:
+            return m.Unmarshal(data)
+        }
+        if e := rv.Elem(); e.Kind() == reflect.Ptr && e.IsNil() {
+            e.Set(reflect.New(e.Type().Elem()))
+        }
+        rv = rv.Elem()
+    }
+    return fmt.Errorf("store: %T does not unmarshal itself", v)
+}
+
+func marshalSelf(v interface{}) ([]byte, bool, error) {
+    switch m := v.(type) {
+    case encoding.BinaryMarshaler:
+        data, err := m.MarshalBinary()
+        return data, true, err
+    case interface{ Marshal() ([]byte, error) }:
+        data, err := m.Marshal()
+        return data, true, err
+    }
+    return nil, false, nil
+}
@@ -0,0 +1,233 @@
+package store
+
+import (
+    "encoding/binary"
+    "github.com/DGHeroin/vault/store/tuple"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "time"
+)
+
+var ErrInvalidKey = errors.New("store: malformed collection key")
+
+// Keyspace is the part of Store and Bucket a Collection is built on.
+type Keyspace interface {
+    Get(key []byte) ([]byte, error)
+    Put(key, value []byte) error
+    Del(key []byte) error
+    Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error
+    RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error
+}
+
+// Tuple is the composite key of TupleKey, see package tuple.
+type Tuple = tuple.Tuple
+
+// KeyEncoder maps the keys of a Collection to store keys. Encodings preserve
+// order, so that ranges over typed keys sort like the keys themselves.
+type KeyEncoder[K any] interface {
+    EncodeKey(key K) ([]byte, error)
+    DecodeKey(data []byte) (K, error)
+}
+
+// prefixRanger is implemented by key encoders for which the encoded prefix
+// alone would also select keys that do not start with the prefix.
+type prefixRanger[K any] interface {
+    PrefixRange(prefix K) (start, limit []byte, err error)
+}
+
+type Integer interface {
+    ~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+var (
+    StringKey KeyEncoder[string] = stringKey{}
+    BytesKey  KeyEncoder[[]byte] = bytesKey{}
+    // TimeKey encodes times with nanosecond precision, which covers the
+    // years 1678 to 2262. Decoded times are in the local time zone.
+    TimeKey  KeyEncoder[time.Time] = timeKey{}
+    TupleKey KeyEncoder[Tuple]     = tupleKey{}
+)
+
+// IntKey encodes integers as 8 big endian bytes, with the sign bit flipped
+// for signed types. In the root keyspace the largest values collide with the
+// reserved prefix, so integer keys are best kept in a Bucket.
+func IntKey[K Integer]() KeyEncoder[K] {
+    return intKey[K]{}
+}
+
+// Collection stores values of type V under keys of type K, encoding keys with
+// a KeyEncoder and values with a Codec.
+type Collection[K, V any] struct {
+    ks    Keyspace
+    keys  KeyEncoder[K]
+    codec Codec
+}
+
+func NewCollection[K, V any](ks Keyspace, keys KeyEncoder[K], codec Codec) *Collection[K, V] {
+    return &Collection[K, V]{ks: ks, keys: keys, codec: codec}
+}
+func (c *Collection[K, V]) Get(key K) (V, error) {
+    var value V
+    k, err := c.keys.EncodeKey(key)
+    if err != nil {
+        return value, err
+    }
+    data, err := c.ks.Get(k)
+    if err != nil {
+        return value, err
+    }
+    err = c.codec.Unmarshal(data, &value)
+    return value, err
+}
+func (c *Collection[K, V]) Put(key K, value V) error {
+    k, err := c.keys.EncodeKey(key)
+    if err != nil {
+        return err
+    }
+    data, err := c.codec.Marshal(value)
+    if err != nil {
+        return err
+    }
+    return c.ks.Put(k, data)
+}
+
+func (c *Collection[K, V]) Del(key K) error {
+    k, err := c.keys.EncodeKey(key)
+    if err != nil {
+        return err
+    }
+    return c.ks.Del(k)
+}
+
+// Range walks the keys in [start, limit); a nil bound is open.
+func (c *Collection[K, V]) Range(start, limit *K, fn func(key K, value V) bool, opts ...*RangeOptions) error {
+    var s, l []byte
+    var err error
+    if start != nil {
+        if s, err = c.keys.EncodeKey(*start); err != nil {
+            return err
+        }
+    }
+    if limit != nil {
+        if l, err = c.keys.EncodeKey(*limit); err != nil {
+            return err
+        }
+    }
+    return c.walk(func(visit func(key []byte, value []byte) bool) error {
+        return c.ks.Range(s, l, visit, opts...)
+    }, fn)
+}
+
+// RangePrefix walks the keys whose encoding starts with the encoding of
+// prefix: string keys with a common prefix, or tuples starting with the
+// elements of a shorter tuple.
+func (c *Collection[K, V]) RangePrefix(prefix K, fn func(key K, value V) bool, opts ...*RangeOptions) error {
+    if pr, ok := c.keys.(prefixRanger[K]); ok {
+        start, limit, err := pr.PrefixRange(prefix)
+        if err != nil {
+            return err
+        }
+        return c.walk(func(visit func(key []byte, value []byte) bool) error {
+            return c.ks.Range(start, limit, visit, opts...)
+        }, fn)
+    }
+    p, err := c.keys.EncodeKey(prefix)
+    if err != nil {
+        return err
+    }
+    return c.walk(func(visit func(key []byte, value []byte) bool) error {
+        return c.ks.RangePrefix(p, visit, opts...)
+    }, fn)
+}
+
+// walk decodes what the range run passes to visit, stopping at the first
+// key or value that does not decode.
+func (c *Collection[K, V]) walk(run func(visit func(key []byte, value []byte) bool) error, fn func(key K, value V) bool) error {
+    var derr error
+    err := run(func(k []byte, data []byte) bool {
+        key, err := c.keys.DecodeKey(k)
+        if err != nil {
+            derr = err
+            return false
+        }
+        var value V
+        if data != nil {
+            if err := c.codec.Unmarshal(data, &value); err != nil {
+                derr = err
+                return false
+            }
+        }
+        return fn(key, value)
+    })
+    if err != nil {
+        return err
+    }
+    return derr
+}
+
+type stringKey struct{}
+
+func (stringKey) EncodeKey(key string) ([]byte, error) {
+    return []byte(key), nil
+}
+func (stringKey) DecodeKey(data []byte) (string, error) {
+    return string(data), nil
+}
+
+type bytesKey struct{}
+
+func (bytesKey) EncodeKey(key []byte) ([]byte, error) {
+    return key, nil
+}
+func (bytesKey) DecodeKey(data []byte) ([]byte, error) {
+    return data, nil
+}
+
+type intKey[K Integer] struct{}
+
+func (intKey[K]) EncodeKey(key K) ([]byte, error) {
+    u := uint64(key)
+    if ^K(0) < 0 {
+        u ^= 1 << 63
+    }
+    return encodeUint64(u), nil
+}
+func (intKey[K]) DecodeKey(data []byte) (K, error) {
+    if len(data) != 8 {
+        return 0, ErrInvalidKey
+    }
+    u := binary.BigEndian.Uint64(data)
+    if ^K(0) < 0 {
+        u ^= 1 << 63
+    }
+    return K(u), nil
+}
+
+type timeKey struct{}
+
+func (timeKey) EncodeKey(key time.Time) ([]byte, error) {
+    return encodeUint64(uint64(key.UnixNano()) ^ 1<<63), nil
+}
+func (timeKey) DecodeKey(data []byte) (time.Time, error) {
+    if len(data) != 8 {
+        return time.Time{}, ErrInvalidKey
+    }
+    return time.Unix(0, int64(binary.BigEndian.Uint64(data)^1<<63)), nil
+}
+
+type tupleKey struct{}
+
+func (tupleKey) EncodeKey(key Tuple) ([]byte, error) {
+    return tuple.Pack(key)
+}
+func (tupleKey) DecodeKey(data []byte) (Tuple, error) {
+    return tuple.Unpack(data)
+}
+func (tupleKey) PrefixRange(prefix Tuple) ([]byte, []byte, error) {
+    return tuple.Range(prefix)
+}
+
+func encodeUint64(u uint64) []byte {
+    buf := make([]byte, 8)
+    binary.BigEndian.PutUint64(buf, u)
+    return buf
+}
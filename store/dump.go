@@ -0,0 +1,488 @@
+package store
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "github.com/golang/snappy"
+    "github.com/klauspost/compress/zstd"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "hash/crc32"
+    "io"
+)
+
+// Dump format, version 1. All integers are big endian.
+//
+//    header:  magic[8] | version u8 | compression u8 | reserved u16
+//    block:   'B' | raw size u32 | data size u32 | crc32c(data) u32 | data
+//    trailer: 'E' | records u64 | blocks u64 | crc32c(records, blocks) u32
+//
+// data is the (possibly compressed) concatenation of records, each encoded
+// like the legacy format: key size u32 | value size u32 | key | value.
+// Streams without the magic header are read as the legacy format.
+const (
+    dumpVersion   = 1
+    dumpBlockSize = 64 << 10
+    // maxDumpBlock bounds the decoded size of a block or legacy record
+    // read back, so that a corrupted size is reported rather than allocated.
+    maxDumpBlock = 1 << 30
+
+    blockTag   = 'B'
+    trailerTag = 'E'
+)
+
+var (
+    dumpMagic  = []byte("VAULTDMP")
+    castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+    ErrUnknownCompression = errors.New("store: unknown dump compression")
+)
+
+type Compression byte
+
+const (
+    NoCompression Compression = iota
+    SnappyCompression
+    ZstdCompression
+)
+
+type DumpOptions struct {
+    Compression Compression
+    BlockSize   int // uncompressed bytes per block, 64KiB by default
+}
+
+// CorruptionError reports a dump that cannot be loaded. Offset is the
+// position in the stream where the problem was found.
+type CorruptionError struct {
+    Offset int64
+    Reason string
+}
+
+func (e *CorruptionError) Error() string {
+    return fmt.Sprintf("store: corrupted dump at offset %d: %s", e.Offset, e.Reason)
+}
+
+func (s *Store) Dump(w io.Writer, opts ...*DumpOptions) error {
+    shot, err := s.db.GetSnapshot()
+    if err != nil {
+        return err
+    }
+    defer shot.Release()
+    return dump(shot, w, opts)
+}
+
+// dump writes every key of rd, metadata included.
+func dump(rd reader, w io.Writer, opts []*DumpOptions) error {
+    opt := &DumpOptions{}
+    if len(opts) > 0 && opts[0] != nil {
+        opt = opts[0]
+    }
+    blockSize := opt.BlockSize
+    if blockSize <= 0 {
+        blockSize = dumpBlockSize
+    }
+    compress, release, err := compressor(opt.Compression)
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    it := rd.NewIterator(nil)
+    defer it.Release()
+
+    bw := bufio.NewWriter(w)
+    header := make([]byte, 12)
+    copy(header, dumpMagic)
+    header[8] = dumpVersion
+    header[9] = byte(opt.Compression)
+    if _, err := bw.Write(header); err != nil {
+        return err
+    }
+
+    var (
+        raw     []byte
+        records uint64
+        blocks  uint64
+    )
+    flush := func() error {
+        if len(raw) == 0 {
+            return nil
+        }
+        data := compress(raw)
+        head := make([]byte, 13)
+        head[0] = blockTag
+        binary.BigEndian.PutUint32(head[1:], uint32(len(raw)))
+        binary.BigEndian.PutUint32(head[5:], uint32(len(data)))
+        binary.BigEndian.PutUint32(head[9:], crc32.Checksum(data, castagnoli))
+        if _, err := bw.Write(head); err != nil {
+            return err
+        }
+        if _, err := bw.Write(data); err != nil {
+            return err
+        }
+        raw = raw[:0]
+        blocks++
+        return nil
+    }
+    for it.Next() {
+        raw = appendRecord(raw, it.Key(), it.Value())
+        records++
+        if len(raw) >= blockSize {
+            if err := flush(); err != nil {
+                return err
+            }
+        }
+    }
+    if err := it.Error(); err != nil {
+        return err
+    }
+    if err := flush(); err != nil {
+        return err
+    }
+
+    trailer := make([]byte, 21)
+    trailer[0] = trailerTag
+    binary.BigEndian.PutUint64(trailer[1:], records)
+    binary.BigEndian.PutUint64(trailer[9:], blocks)
+    binary.BigEndian.PutUint32(trailer[17:], crc32.Checksum(trailer[1:17], castagnoli))
+    if _, err := bw.Write(trailer); err != nil {
+        return err
+    }
+    return bw.Flush()
+}
+
+type LoadOptions struct {
+    BatchSize int  // records per write batch, 1024 by default
+    Wipe      bool // delete all existing data first instead of merging into it, unless the dump fails before its first batch
+    // Progress, when set, is called after every batch written.
+    Progress func(LoadProgress)
+}
+
+type LoadProgress struct {
+    Records uint64 // records written so far
+    Bytes   int64  // bytes consumed from the dump so far
+}
+
+func (s *Store) Load(r io.Reader, opts ...*LoadOptions) error {
+    l := &loader{
+        s:     s,
+        r:     &countingReader{r: bufio.NewReader(r)},
+        opt:   &LoadOptions{},
+        batch: new(writeBatch),
+    }
+    if len(opts) > 0 && opts[0] != nil {
+        l.opt = opts[0]
+    }
+    if l.size = l.opt.BatchSize; l.size <= 0 {
+        l.size = loadBatchSize
+    }
+    head := make([]byte, len(dumpMagic))
+    n, err := io.ReadFull(l.r, head)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+        return err
+    }
+    // the store is wiped by the first write, once what it writes checked out
+    l.wipe = l.opt.Wipe
+    if n == len(dumpMagic) && bytes.Equal(head, dumpMagic) {
+        err = l.loadBlocks()
+    } else {
+        err = l.loadLegacy(head[:n])
+    }
+    if err != nil {
+        return err
+    }
+    return l.flush()
+}
+
+// wipe deletes every key of the store, metadata included.
+func (s *Store) wipe(size int) error {
+    for {
+        s.mu.Lock()
+        b := new(writeBatch)
+        n := 0
+        it := s.db.NewIterator(nil)
+        for n < size && it.Next() {
+            b.deleteRaw(copyBytes(it.Key()))
+            n++
+        }
+        it.Release()
+        err := it.Error()
+        if err == nil && n > 0 {
+            err = s.writeLocked(b)
+        }
+        s.mu.Unlock()
+        if err != nil {
+            return err
+        }
+        if n < size {
+            return s.db.CompactRange(util.Range{})
+        }
+    }
+}
+
+const loadBatchSize = 1024
+
+// loader writes the records of a dump in batches.
+type loader struct {
+    s       *Store
+    r       *countingReader
+    opt     *LoadOptions
+    size    int
+    batch   *writeBatch
+    pending int
+    records uint64
+    wipe    bool // before the next write
+}
+
+func (l *loader) put(key, value []byte) error {
+    l.batch.putRaw(key, value)
+    l.pending++
+    if l.pending >= l.size {
+        return l.flush()
+    }
+    return nil
+}
+func (l *loader) flush() error {
+    if l.wipe {
+        if err := l.s.wipe(l.size); err != nil {
+            return err
+        }
+        l.wipe = false
+    }
+    if l.pending == 0 {
+        return nil
+    }
+    l.s.mu.Lock()
+    err := l.s.writeLocked(l.batch)
+    l.s.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    l.records += uint64(l.pending)
+    l.pending = 0
+    l.batch = new(writeBatch)
+    if l.opt.Progress != nil {
+        l.opt.Progress(LoadProgress{Records: l.records, Bytes: l.r.n})
+    }
+    return nil
+}
+
+// loadLegacy reads the headerless format written by older versions, where
+// the stream may only end on a record boundary. head holds bytes already
+// consumed from the stream.
+func (l *loader) loadLegacy(head []byte) error {
+    r := l.r
+    offset := r.n - int64(len(head))
+    rd := io.MultiReader(bytes.NewReader(head), r)
+    header := make([]byte, 8)
+    for {
+        if _, err := io.ReadFull(rd, header); err == io.EOF {
+            return nil
+        } else if err == io.ErrUnexpectedEOF {
+            return &CorruptionError{Offset: offset, Reason: "truncated record header"}
+        } else if err != nil {
+            return err
+        }
+        ks := binary.BigEndian.Uint32(header)
+        vs := binary.BigEndian.Uint32(header[4:])
+        if int64(ks)+int64(vs) > maxDumpBlock {
+            return &CorruptionError{Offset: offset, Reason: "record too large"}
+        }
+        kv, err := readSized(rd, int64(ks)+int64(vs))
+        if err == io.ErrUnexpectedEOF {
+            return &CorruptionError{Offset: offset, Reason: "truncated record"}
+        } else if err != nil {
+            return err
+        }
+        if err := l.put(kv[:ks], kv[ks:]); err != nil {
+            return err
+        }
+        offset += 8 + int64(len(kv))
+    }
+}
+
+func (l *loader) loadBlocks() error {
+    r := l.r
+    head := make([]byte, 4)
+    if err := readDump(r, head, "truncated header"); err != nil {
+        return err
+    }
+    if head[0] != dumpVersion {
+        return &CorruptionError{Offset: r.n - 4, Reason: fmt.Sprintf("unsupported version %d", head[0])}
+    }
+    decompress, release, err := decompressor(Compression(head[1]))
+    if err != nil {
+        return &CorruptionError{Offset: r.n - 3, Reason: err.Error()}
+    }
+    defer release()
+
+    var (
+        records uint64
+        blocks  uint64
+        tag     = make([]byte, 1)
+    )
+    for {
+        offset := r.n
+        if err := readDump(r, tag, "missing trailer"); err != nil {
+            return err
+        }
+        switch tag[0] {
+        case blockTag:
+            bh := make([]byte, 12)
+            if err := readDump(r, bh, "truncated block header"); err != nil {
+                return err
+            }
+            rawSize, dataSize := binary.BigEndian.Uint32(bh), binary.BigEndian.Uint32(bh[4:])
+            if rawSize > maxDumpBlock || dataSize > maxDumpBlock {
+                return &CorruptionError{Offset: offset, Reason: "block too large"}
+            }
+            data, err := readSized(r, int64(dataSize))
+            if err == io.ErrUnexpectedEOF {
+                return &CorruptionError{Offset: offset, Reason: "truncated block"}
+            } else if err != nil {
+                return err
+            }
+            if crc32.Checksum(data, castagnoli) != binary.BigEndian.Uint32(bh[8:]) {
+                return &CorruptionError{Offset: offset, Reason: "block checksum mismatch"}
+            }
+            raw, err := decompress(data, int(rawSize))
+            if err != nil || len(raw) != int(rawSize) {
+                return &CorruptionError{Offset: offset, Reason: "cannot decompress block"}
+            }
+            n, err := l.loadRecords(raw, offset)
+            if err != nil {
+                return err
+            }
+            records += n
+            blocks++
+        case trailerTag:
+            trailer := make([]byte, 20)
+            if err := readDump(r, trailer, "truncated trailer"); err != nil {
+                return err
+            }
+            if crc32.Checksum(trailer[:16], castagnoli) != binary.BigEndian.Uint32(trailer[16:]) {
+                return &CorruptionError{Offset: offset, Reason: "trailer checksum mismatch"}
+            }
+            if binary.BigEndian.Uint64(trailer) != records || binary.BigEndian.Uint64(trailer[8:]) != blocks {
+                return &CorruptionError{Offset: offset, Reason: "record count mismatch"}
+            }
+            if _, err := r.Read(tag); err != io.EOF {
+                return &CorruptionError{Offset: r.n, Reason: "unexpected data after trailer"}
+            }
+            return nil
+        default:
+            return &CorruptionError{Offset: offset, Reason: fmt.Sprintf("unknown tag %q", tag[0])}
+        }
+    }
+}
+
+// loadRecords writes the records of one decoded block, offset being the
+// position of the block in the stream.
+func (l *loader) loadRecords(raw []byte, offset int64) (uint64, error) {
+    var n uint64
+    for len(raw) > 0 {
+        if len(raw) < 8 {
+            return n, &CorruptionError{Offset: offset, Reason: "truncated record in block"}
+        }
+        ks := int(binary.BigEndian.Uint32(raw))
+        vs := int(binary.BigEndian.Uint32(raw[4:]))
+        if len(raw)-8 < ks+vs {
+            return n, &CorruptionError{Offset: offset, Reason: "truncated record in block"}
+        }
+        if err := l.put(raw[8:8+ks], raw[8+ks:8+ks+vs]); err != nil {
+            return n, err
+        }
+        raw = raw[8+ks+vs:]
+        n++
+    }
+    return n, nil
+}
+
+func appendRecord(buf, key, value []byte) []byte {
+    var header [8]byte
+    binary.BigEndian.PutUint32(header[:], uint32(len(key)))
+    binary.BigEndian.PutUint32(header[4:], uint32(len(value)))
+    buf = append(buf, header[:]...)
+    buf = append(buf, key...)
+    return append(buf, value...)
+}
+
+// readSized reads n bytes from r, growing the buffer as they arrive rather
+// than trusting n up front: a corrupted size fails on the short read instead
+// of allocating it.
+func readSized(r io.Reader, n int64) ([]byte, error) {
+    var buf bytes.Buffer
+    if n <= dumpBlockSize {
+        buf.Grow(int(n))
+    }
+    m, err := io.CopyN(&buf, r, n)
+    if m < n && err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return buf.Bytes(), err
+}
+
+// readDump fills buf, turning a short read into a CorruptionError.
+func readDump(r *countingReader, buf []byte, reason string) error {
+    offset := r.n
+    _, err := io.ReadFull(r, buf)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return &CorruptionError{Offset: offset, Reason: reason}
+    }
+    return err
+}
+
+func compressor(c Compression) (compress func([]byte) []byte, release func(), err error) {
+    switch c {
+    case NoCompression:
+        return func(raw []byte) []byte { return raw }, func() {}, nil
+    case SnappyCompression:
+        return func(raw []byte) []byte { return snappy.Encode(nil, raw) }, func() {}, nil
+    case ZstdCompression:
+        enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+        if err != nil {
+            return nil, nil, err
+        }
+        return func(raw []byte) []byte { return enc.EncodeAll(raw, nil) }, func() { _ = enc.Close() }, nil
+    }
+    return nil, nil, ErrUnknownCompression
+}
+func decompressor(c Compression) (decompress func(data []byte, size int) ([]byte, error), release func(), err error) {
+    switch c {
+    case NoCompression:
+        return func(data []byte, _ int) ([]byte, error) { return data, nil }, func() {}, nil
+    case SnappyCompression:
+        return func(data []byte, size int) ([]byte, error) {
+            if n, err := snappy.DecodedLen(data); err != nil || n != size {
+                return nil, snappy.ErrCorrupt
+            }
+            return snappy.Decode(nil, data)
+        }, func() {}, nil
+    case ZstdCompression:
+        dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDumpBlock))
+        if err != nil {
+            return nil, nil, err
+        }
+        return func(data []byte, size int) ([]byte, error) {
+            if size > dumpBlockSize {
+                // grown as decoded, the size is not trusted before then
+                size = dumpBlockSize
+            }
+            return dec.DecodeAll(data, make([]byte, 0, size))
+        }, dec.Close, nil
+    }
+    return nil, nil, ErrUnknownCompression
+}
+
+type countingReader struct {
+    r io.Reader
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.n += int64(n)
+    return n, err
+}
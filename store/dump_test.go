@@ -0,0 +1,45 @@
+package store
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestLoadWipeKeepsDataOnBadDump(t *testing.T) {
+    s, err := New(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    if err := s.Put([]byte("k"), []byte("v")); err != nil {
+        t.Fatal(err)
+    }
+    var dump bytes.Buffer
+    if err := s.Dump(&dump); err != nil {
+        t.Fatal(err)
+    }
+    bad := map[string][]byte{
+        "garbage":       []byte("definitely not a dump of this store"),
+        "bad version":   append(append([]byte(nil), dumpMagic...), 9, 0, 0, 0),
+        "truncated":     dump.Bytes()[:len(dump.Bytes())-30],
+        "bad block crc": corruptBlock(dump.Bytes()),
+    }
+    for name, data := range bad {
+        if err := s.Load(bytes.NewReader(data), &LoadOptions{Wipe: true}); err == nil {
+            t.Fatalf("%s: loaded", name)
+        }
+        if v, err := s.Get([]byte("k")); err != nil || string(v) != "v" {
+            t.Fatalf("%s: got %q, %v", name, v, err)
+        }
+    }
+    if err := s.Load(bytes.NewReader(dump.Bytes()), &LoadOptions{Wipe: true}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// corruptBlock flips a byte of the data of the first block of dump.
+func corruptBlock(dump []byte) []byte {
+    data := append([]byte(nil), dump...)
+    data[12+13] ^= 0xff
+    return data
+}
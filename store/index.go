@@ -0,0 +1,354 @@
+package store
+
+import (
+    "bytes"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "strings"
+)
+
+var (
+    ErrInvalidIndex = errors.New("store: invalid index")
+    ErrUnknownIndex = errors.New("store: index is not registered")
+)
+
+// Index entries live in the reserved keyspace, one per indexed value of a key:
+//
+//    indexPrefix + space + name + 0x00 + escaped value + key -> empty
+//    indexRegistryPrefix + space + name                       -> empty, once the index is built
+//
+// space is 0x00 for the root keyspace and the bucket name + 0x00 for a bucket.
+// Values are escaped (0x00 -> 0x00 0xff) and terminated by 0x00 0x01, so that
+// entries sort by value, then by key.
+var (
+    indexPrefix         = []byte("\xff\xffi")
+    indexRegistryPrefix = []byte("\xff\xffI")
+)
+
+// IndexFunc returns the values under which key is indexed, or none to leave
+// it out of the index. It must be deterministic and must not retain key or
+// value.
+type IndexFunc func(key, value []byte) [][]byte
+
+type index struct {
+    name string
+    base []byte // prefix of the entries
+    fn   IndexFunc
+}
+
+// RegisterIndex maintains the index name over the root keyspace with fn.
+// Indexes are not persisted with their function, so they must be registered
+// again every time the store is opened. An index that was never built is
+// built from the existing keys, blocking writers meanwhile.
+func (s *Store) RegisterIndex(name string, fn IndexFunc) error {
+    return s.registerIndex(nil, name, fn)
+}
+
+// RebuildIndex rebuilds the index name from scratch, which is needed after
+// its IndexFunc changed. Writers are blocked meanwhile.
+func (s *Store) RebuildIndex(name string) error {
+    return s.rebuildIndex(nil, name)
+}
+
+// DropIndex unregisters the index name and deletes its entries.
+func (s *Store) DropIndex(name string) error {
+    return s.dropIndex(nil, name)
+}
+
+// QueryIndex walks the keys indexed under value, in key order. Reverse, Max,
+// After and KeysOnly apply as in Range.
+func (s *Store) QueryIndex(name string, value []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return s.queryIndex(nil, name, value, fn, rangeOptions(opts))
+}
+
+// QueryIndexRange walks the keys indexed under a value in [start, limit),
+// ordered by value, then by key. A key indexed under several values of the
+// range is visited once per value. Reverse, Max and KeysOnly apply as in
+// Range; After is ignored.
+func (s *Store) QueryIndexRange(name string, start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return s.queryIndexRange(nil, name, start, limit, fn, rangeOptions(opts))
+}
+
+func (s *Store) registerIndex(scope []byte, name string, fn IndexFunc) error {
+    if name == "" || strings.IndexByte(name, 0) >= 0 || fn == nil {
+        return ErrInvalidIndex
+    }
+    ix := &index{name: name, base: indexBase(scope, name), fn: fn}
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if ok, err := s.db.Has(indexRegistryKey(scope, name)); err != nil {
+        return err
+    } else if !ok {
+        if err := s.buildIndex(scope, ix); err != nil {
+            return err
+        }
+    }
+    indexes := s.indexes[string(scope)]
+    for i, old := range indexes {
+        if old.name == name {
+            indexes[i] = ix
+            return nil
+        }
+    }
+    s.indexes[string(scope)] = append(indexes, ix)
+    return nil
+}
+func (s *Store) rebuildIndex(scope []byte, name string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ix := s.index(scope, name)
+    if ix == nil {
+        return ErrUnknownIndex
+    }
+    return s.buildIndex(scope, ix)
+}
+func (s *Store) dropIndex(scope []byte, name string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.index(scope, name) == nil {
+        return ErrUnknownIndex
+    }
+    indexes := s.indexes[string(scope)]
+    for i, ix := range indexes {
+        if ix.name == name {
+            indexes = append(indexes[:i:i], indexes[i+1:]...)
+            break
+        }
+    }
+    if len(indexes) == 0 {
+        delete(s.indexes, string(scope))
+    } else {
+        s.indexes[string(scope)] = indexes
+    }
+    if err := s.clearRangeLocked(util.BytesPrefix(indexBase(scope, name))); err != nil {
+        return err
+    }
+    b := new(writeBatch)
+    b.deleteRaw(indexRegistryKey(scope, name))
+    return s.writeLocked(b)
+}
+
+// queryIndex walks the keys indexed under value.
+func (s *Store) queryIndex(scope []byte, name string, value []byte, fn func(key []byte, value []byte) bool, opt *RangeOptions) error {
+    r := util.BytesPrefix(appendIndexValue(indexBase(scope, name), value))
+    if opt.After != nil {
+        r = resumeRange(r, &RangeOptions{
+            Reverse: opt.Reverse,
+            After:   append(copyBytes(r.Start), opt.After...),
+        })
+    }
+    return s.walkIndex(scope, name, r, fn, opt)
+}
+
+// queryIndexRange walks the keys indexed under a value in [start, limit).
+func (s *Store) queryIndexRange(scope []byte, name string, start, limit []byte, fn func(key []byte, value []byte) bool, opt *RangeOptions) error {
+    base := indexBase(scope, name)
+    r := util.BytesPrefix(base)
+    if start != nil {
+        r.Start = appendIndexValue(copyBytes(base), start)
+    }
+    if limit != nil {
+        r.Limit = appendIndexValue(copyBytes(base), limit)
+    }
+    if bytes.Compare(r.Start, r.Limit) >= 0 {
+        return nil
+    }
+    return s.walkIndex(scope, name, r, fn, opt)
+}
+
+// walkIndex walks the index entries of r, reading from a snapshot so that
+// entries and records agree.
+func (s *Store) walkIndex(scope []byte, name string, r *util.Range, fn func(key []byte, value []byte) bool, opt *RangeOptions) error {
+    s.mu.Lock()
+    ix := s.index(scope, name)
+    s.mu.Unlock()
+    if ix == nil {
+        return ErrUnknownIndex
+    }
+    snap, err := s.db.GetSnapshot()
+    if err != nil {
+        return err
+    }
+    defer snap.Release()
+    it := snap.NewIterator(r)
+    defer it.Release()
+    n := 0
+    for ok := first(it, opt.Reverse); ok; ok = next(it, opt.Reverse) {
+        key := indexEntryKey(it.Key()[len(ix.base):])
+        if key == nil {
+            continue
+        }
+        full, _ := scopeKey(scope, key)
+        var value []byte
+        if opt.KeysOnly {
+            if isExpired(snap, full) {
+                continue
+            }
+        } else if value, err = get(snap, full); err == ErrNotFound {
+            continue
+        } else if err != nil {
+            return err
+        }
+        if !fn(copyBytes(key), value) {
+            break
+        }
+        if n++; opt.Max > 0 && n >= opt.Max {
+            break
+        }
+    }
+    return it.Error()
+}
+
+// index returns the registered index name of scope. It is called with s.mu
+// held.
+func (s *Store) index(scope []byte, name string) *index {
+    for _, ix := range s.indexes[string(scope)] {
+        if ix.name == name {
+            return ix
+        }
+    }
+    return nil
+}
+
+// buildIndex replaces the entries of ix with ones computed from the keys of
+// scope. It is called with s.mu held.
+func (s *Store) buildIndex(scope []byte, ix *index) error {
+    if err := s.clearRangeLocked(util.BytesPrefix(ix.base)); err != nil {
+        return err
+    }
+    it := s.db.NewIterator(scopeRange(scope, &util.Range{}))
+    defer it.Release()
+    b := new(writeBatch)
+    n := 0
+    for it.Next() {
+        key := it.Key()[len(scope):]
+        for _, v := range ix.fn(key, it.Value()) {
+            b.batch.Put(ix.entry(v, key), nil)
+        }
+        if n++; n >= dropBatch {
+            if err := s.writeLocked(b); err != nil {
+                return err
+            }
+            b, n = new(writeBatch), 0
+        }
+    }
+    if err := it.Error(); err != nil {
+        return err
+    }
+    b.putRaw(indexRegistryKey(scope, ix.name), nil)
+    return s.writeLocked(b)
+}
+
+// updateIndexes adds to b the index entries its writes add and remove. It is
+// called with s.mu held, before b is written.
+func (s *Store) updateIndexes(b *writeBatch) error {
+    type state struct {
+        value  []byte
+        exists bool
+    }
+    var latest map[string]state // keys written earlier in b
+    for _, c := range b.changes {
+        if c.typ == 0 {
+            continue
+        }
+        scope := keyScope(c.key)
+        indexes := s.indexes[string(scope)]
+        if len(indexes) == 0 {
+            continue
+        }
+        if latest == nil {
+            latest = make(map[string]state)
+        }
+        old, seen := latest[string(c.key)]
+        if !seen {
+            value, err := s.db.Get(c.key)
+            if err != nil && err != ErrNotFound {
+                return err
+            }
+            old = state{value: value, exists: err == nil}
+        }
+        cur := state{value: c.value, exists: c.typ == EventPut}
+        key := c.key[len(scope):]
+        for _, ix := range indexes {
+            if old.exists {
+                for _, v := range ix.fn(key, old.value) {
+                    b.batch.Delete(ix.entry(v, key))
+                }
+            }
+            if cur.exists {
+                for _, v := range ix.fn(key, cur.value) {
+                    b.batch.Put(ix.entry(v, key), nil)
+                }
+            }
+        }
+        latest[string(c.key)] = cur
+    }
+    return nil
+}
+
+func (ix *index) entry(value, key []byte) []byte {
+    entry := make([]byte, 0, len(ix.base)+len(value)+2+len(key))
+    entry = appendIndexValue(append(entry, ix.base...), value)
+    return append(entry, key...)
+}
+
+// appendIndexValue appends value escaped and terminated.
+func appendIndexValue(dst, value []byte) []byte {
+    for _, c := range value {
+        dst = append(dst, c)
+        if c == 0 {
+            dst = append(dst, 0xff)
+        }
+    }
+    return append(dst, 0, 1)
+}
+
+// indexEntryKey returns the key of an entry stripped of its index prefix, or
+// nil when the entry is malformed.
+func indexEntryKey(entry []byte) []byte {
+    for i := 0; i+1 < len(entry); i++ {
+        if entry[i] != 0 {
+            continue
+        }
+        if entry[i+1] == 1 {
+            return entry[i+2:]
+        }
+        i++
+    }
+    return nil
+}
+
+// indexSpace identifies the keyspace of scope among indexes.
+func indexSpace(scope []byte) []byte {
+    if scope == nil {
+        return []byte{0}
+    }
+    return scope[len(bucketPrefix):]
+}
+func indexBase(scope []byte, name string) []byte {
+    space := indexSpace(scope)
+    base := make([]byte, 0, len(indexPrefix)+len(space)+len(name)+1)
+    base = append(base, indexPrefix...)
+    base = append(base, space...)
+    base = append(base, name...)
+    return append(base, 0)
+}
+func indexRegistryKey(scope []byte, name string) []byte {
+    space := indexSpace(scope)
+    key := make([]byte, 0, len(indexRegistryPrefix)+len(space)+len(name))
+    key = append(key, indexRegistryPrefix...)
+    key = append(key, space...)
+    return append(key, name...)
+}
+
+// keyScope returns the scope of a data key.
+func keyScope(key []byte) []byte {
+    if !bytes.HasPrefix(key, bucketPrefix) {
+        return nil
+    }
+    i := bytes.IndexByte(key[len(bucketPrefix):], 0)
+    if i < 0 {
+        return nil
+    }
+    return key[:len(bucketPrefix)+i+1]
+}
@@ -0,0 +1,420 @@
+package store
+
+import (
+    "bytes"
+    "encoding/binary"
+    "github.com/syndtr/goleveldb/leveldb"
+    "github.com/syndtr/goleveldb/leveldb/iterator"
+    "github.com/syndtr/goleveldb/leveldb/memdb"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "math"
+    "sort"
+    "sync"
+)
+
+// The memory backend keeps every key under versions, like leveldb does: a
+// write adds the key suffixed with its sequence number, and the value
+// prefixed with whether it was put or deleted. A snapshot is the sequence
+// number of the last write it sees, so taking one copies nothing. The
+// writes of a batch share one sequence number, which live reads see once the
+// whole batch is in: they run under the lock, and live iterators hold a
+// snapshot.
+//
+// Versions no snapshot can read are dropped as their key is written again,
+// and the ones kept for a snapshot once it is released.
+
+const (
+    versionDelete byte = iota
+    versionPut
+)
+const (
+    unpositioned = iota
+    beforeFirst
+    afterLast
+)
+
+// NewMemoryBackend returns an empty in-memory Backend built on goleveldb's
+// memdb, meant for tests and small throwaway stores.
+func NewMemoryBackend() Backend {
+    return &memory{
+        db:    memdb.New(versionComparer{}, 0),
+        snaps: make(map[uint64]int),
+        stale: make(map[uint64]map[string]struct{}),
+    }
+}
+
+type (
+    memory struct {
+        mu    sync.Mutex // guards seq, snaps and stale, and orders writes and live reads
+        db    *memdb.DB
+        seq   uint64                         // of the last write
+        snaps map[uint64]int                 // live snapshots by sequence number
+        iters int                            // live iterators, holding snapshots of their own
+        stale map[uint64]map[string]struct{} // keys holding versions for a snapshot
+    }
+    // versionComparer orders versioned keys by key, then newest first.
+    versionComparer struct{}
+    memoryReplay    struct {
+        m   *memory
+        seq uint64
+    }
+    memorySnapshot struct {
+        m        *memory
+        seq      uint64
+        released bool
+    }
+    // memoryIterator walks the keys visible at seq.
+    memoryIterator struct {
+        util.BasicReleaser
+        it         iterator.Iterator // over versioned keys
+        seq        uint64
+        key, value []byte
+        valid      bool
+        // at tells where an iterator that is not valid stands: unpositioned,
+        // before the first key or after the last one
+        at   int
+        snap *memorySnapshot // held by the iterators of the live backend
+    }
+)
+
+// versioned returns key at version seq, which sorts before older versions.
+func versioned(key []byte, seq uint64) []byte {
+    v := make([]byte, len(key)+8)
+    copy(v, key)
+    binary.BigEndian.PutUint64(v[len(key):], ^seq)
+    return v
+}
+func splitVersion(v []byte) ([]byte, uint64) {
+    n := len(v) - 8
+    return v[:n], ^binary.BigEndian.Uint64(v[n:])
+}
+
+func (versionComparer) Compare(a, b []byte) int {
+    ka, sa := splitVersion(a)
+    kb, sb := splitVersion(b)
+    if c := bytes.Compare(ka, kb); c != 0 {
+        return c
+    }
+    switch {
+    case sa > sb:
+        return -1
+    case sa < sb:
+        return 1
+    }
+    return 0
+}
+
+// get reads key as of seq.
+func (m *memory) get(key []byte, seq uint64) ([]byte, error) {
+    v, value, err := m.db.Find(versioned(key, seq))
+    if err != nil {
+        return nil, ErrNotFound
+    }
+    if k, _ := splitVersion(v); !bytes.Equal(k, key) || value[0] != versionPut {
+        return nil, ErrNotFound
+    }
+    return copyBytes(value[1:]), nil
+}
+func (m *memory) Get(key []byte) ([]byte, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.get(key, m.seq)
+}
+func (m *memory) Has(key []byte) (bool, error) {
+    _, err := m.Get(key)
+    if err == ErrNotFound {
+        return false, nil
+    }
+    return err == nil, err
+}
+func (m *memory) Put(key, value []byte) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.write(key, value, versionPut, m.seq+1)
+    m.seq++
+    return nil
+}
+func (m *memory) Delete(key []byte) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.write(key, nil, versionDelete, m.seq+1)
+    m.seq++
+    return nil
+}
+
+// Write replays batch at the next sequence number, which becomes the one of
+// the last write once all of it is in.
+func (m *memory) Write(batch *leveldb.Batch) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := batch.Replay(memoryReplay{m: m, seq: m.seq + 1}); err != nil {
+        return err
+    }
+    m.seq++
+    return nil
+}
+
+// NewIterator returns an iterator over the backend as of now, which holds a
+// snapshot until released.
+func (m *memory) NewIterator(r *util.Range) iterator.Iterator {
+    snap := m.snapshot()
+    m.mu.Lock()
+    m.iters++
+    m.mu.Unlock()
+    it := m.iterator(r, snap.seq)
+    it.snap = snap
+    return it
+}
+func (m *memory) GetSnapshot() (BackendSnapshot, error) {
+    return m.snapshot(), nil
+}
+func (m *memory) snapshot() *memorySnapshot {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.snaps[m.seq]++
+    return &memorySnapshot{m: m, seq: m.seq}
+}
+func (m *memory) CompactRange(r util.Range) error {
+    return nil
+}
+func (m *memory) Close() error {
+    return nil
+}
+
+// write records a version of key and drops the older ones no snapshot
+// reads. It is called with m.mu held.
+func (m *memory) write(key, value []byte, kind byte, seq uint64) {
+    _ = m.db.Put(versioned(key, seq), append([]byte{kind}, value...))
+    m.prune(key)
+}
+
+// prune drops the versions of key that neither the live backend nor a
+// snapshot reads, remembering it for the snapshots that keep others. It is
+// called with m.mu held.
+func (m *memory) prune(key []byte) {
+    snaps := make([]uint64, 0, len(m.snaps))
+    for seq := range m.snaps {
+        snaps = append(snaps, seq)
+    }
+    sort.Slice(snaps, func(i, j int) bool {
+        return snaps[i] > snaps[j]
+    })
+    type version struct {
+        v      []byte
+        delete bool
+        keep   bool
+        snaps  []uint64 // reading it, but for the live backend
+    }
+    var versions []version
+    it := m.db.NewIterator(&util.Range{Start: versioned(key, math.MaxUint64), Limit: versioned(key, 0)})
+    for i := 0; it.Next(); i++ {
+        _, seq := splitVersion(it.Key())
+        ver := version{v: copyBytes(it.Key()), delete: it.Value()[0] == versionDelete, keep: i == 0}
+        // the versions come newest first: this one is read by the
+        // snapshots taken since it was written, and before the newer one
+        for len(snaps) > 0 && snaps[0] >= seq {
+            ver.keep = true
+            ver.snaps = append(ver.snaps, snaps[0])
+            snaps = snaps[1:]
+        }
+        versions = append(versions, ver)
+    }
+    it.Release()
+    // deleted with nothing older, a key reads the same as never written
+    for i := len(versions) - 1; i >= 0; i-- {
+        if !versions[i].keep {
+            continue
+        }
+        if !versions[i].delete {
+            break
+        }
+        versions[i].keep = false
+    }
+    kept := 0
+    for _, ver := range versions {
+        if !ver.keep {
+            _ = m.db.Delete(ver.v)
+        } else {
+            kept++
+        }
+    }
+    if kept < 2 {
+        return
+    }
+    for _, ver := range versions {
+        for _, seq := range ver.snaps {
+            keys := m.stale[seq]
+            if keys == nil {
+                keys = make(map[string]struct{})
+                m.stale[seq] = keys
+            }
+            keys[string(key)] = struct{}{}
+        }
+    }
+}
+
+// iterator walks the keys of r as of seq.
+func (m *memory) iterator(r *util.Range, seq uint64) *memoryIterator {
+    var vr util.Range
+    if r != nil {
+        if r.Start != nil {
+            vr.Start = versioned(r.Start, math.MaxUint64)
+        }
+        if r.Limit != nil {
+            vr.Limit = versioned(r.Limit, math.MaxUint64)
+        }
+    }
+    return &memoryIterator{it: m.db.NewIterator(&vr), seq: seq}
+}
+
+func (r memoryReplay) Put(key, value []byte) {
+    r.m.write(key, value, versionPut, r.seq)
+}
+func (r memoryReplay) Delete(key []byte) {
+    r.m.write(key, nil, versionDelete, r.seq)
+}
+
+func (m *memorySnapshot) Get(key []byte) ([]byte, error) {
+    return m.m.get(key, m.seq)
+}
+func (m *memorySnapshot) Has(key []byte) (bool, error) {
+    _, err := m.Get(key)
+    if err == ErrNotFound {
+        return false, nil
+    }
+    return err == nil, err
+}
+func (m *memorySnapshot) NewIterator(r *util.Range) iterator.Iterator {
+    return m.m.iterator(r, m.seq)
+}
+
+// Release frees the versions kept for the snapshot alone.
+func (m *memorySnapshot) Release() {
+    m.m.mu.Lock()
+    defer m.m.mu.Unlock()
+    if m.released {
+        return
+    }
+    m.released = true
+    if m.m.snaps[m.seq]--; m.m.snaps[m.seq] > 0 {
+        return
+    }
+    delete(m.m.snaps, m.seq)
+    keys := m.m.stale[m.seq]
+    delete(m.m.stale, m.seq)
+    for key := range keys {
+        m.m.prune([]byte(key))
+    }
+}
+
+// forward stops at the first key visible from the position of the versioned
+// iterator on.
+func (i *memoryIterator) forward() bool {
+    for i.it.Valid() {
+        key, seq := splitVersion(i.it.Key())
+        if seq > i.seq {
+            i.it.Next()
+            continue
+        }
+        if value := i.it.Value(); value[0] == versionPut {
+            return i.set(key, value[1:])
+        }
+        // deleted: skip the older versions
+        if !i.it.Seek(versioned(key, 0)) {
+            break
+        }
+    }
+    i.valid, i.at = false, afterLast
+    return false
+}
+
+// backward stops at the last key visible from the key of the version the
+// versioned iterator is on, that one included.
+func (i *memoryIterator) backward() bool {
+    for i.it.Valid() {
+        key, _ := splitVersion(i.it.Key())
+        key = copyBytes(key)
+        if i.it.Seek(versioned(key, i.seq)) {
+            k, _ := splitVersion(i.it.Key())
+            if value := i.it.Value(); bytes.Equal(k, key) && value[0] == versionPut {
+                return i.set(key, value[1:])
+            }
+        }
+        if i.it.Seek(versioned(key, math.MaxUint64)) {
+            i.it.Prev()
+        } else {
+            i.it.Last()
+        }
+    }
+    i.valid, i.at = false, beforeFirst
+    return false
+}
+func (i *memoryIterator) set(key, value []byte) bool {
+    i.key, i.value, i.valid = copyBytes(key), copyBytes(value), true
+    return true
+}
+func (i *memoryIterator) First() bool {
+    i.it.First()
+    return i.forward()
+}
+func (i *memoryIterator) Last() bool {
+    i.it.Last()
+    return i.backward()
+}
+func (i *memoryIterator) Seek(key []byte) bool {
+    i.it.Seek(versioned(key, math.MaxUint64))
+    return i.forward()
+}
+func (i *memoryIterator) Next() bool {
+    if !i.valid {
+        if i.at != afterLast {
+            return i.First()
+        }
+        return false
+    }
+    i.it.Seek(versioned(i.key, 0))
+    return i.forward()
+}
+func (i *memoryIterator) Prev() bool {
+    if !i.valid {
+        // as goleveldb, from past the last key only
+        if i.at == afterLast {
+            return i.Last()
+        }
+        return false
+    }
+    if i.it.Seek(versioned(i.key, math.MaxUint64)) {
+        i.it.Prev()
+    } else {
+        i.it.Last()
+    }
+    return i.backward()
+}
+func (i *memoryIterator) Valid() bool {
+    return i.valid
+}
+func (i *memoryIterator) Key() []byte {
+    if !i.valid {
+        return nil
+    }
+    return i.key
+}
+func (i *memoryIterator) Value() []byte {
+    if !i.valid {
+        return nil
+    }
+    return i.value
+}
+func (i *memoryIterator) Error() error {
+    return nil
+}
+func (i *memoryIterator) Release() {
+    i.it.Release()
+    if i.snap != nil && !i.Released() {
+        i.snap.m.mu.Lock()
+        i.snap.m.iters--
+        i.snap.m.mu.Unlock()
+        i.snap.Release()
+    }
+    i.BasicReleaser.Release()
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+    "bytes"
+    "strconv"
+    "sync"
+    "testing"
+)
+
+func TestMemoryBatchAtomic(t *testing.T) {
+    s, err := New("", &Options{InMemory: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    const keys = 16
+    put := func(v int) error {
+        return s.BatchPut(func(p Putter) {
+            for i := 0; i < keys; i++ {
+                p.Put([]byte("k"+strconv.Itoa(i)), []byte(strconv.Itoa(v)))
+            }
+        })
+    }
+    if err := put(0); err != nil {
+        t.Fatal(err)
+    }
+    var wg sync.WaitGroup
+    done := make(chan struct{})
+    for w := 0; w < 2; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for v := w; v < 2000; v += 2 {
+                if err := put(v); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }(w)
+    }
+    torn := make(chan string, 1)
+    var rg sync.WaitGroup
+    rg.Add(1)
+    go func() {
+        defer rg.Done()
+        for {
+            select {
+            case <-done:
+                return
+            default:
+            }
+            var first []byte
+            n := 0
+            err := s.Range(nil, nil, func(key, value []byte) bool {
+                if n++; first == nil {
+                    first = value
+                } else if !bytes.Equal(first, value) {
+                    select {
+                    case torn <- string(key) + "=" + string(value) + " after " + string(first):
+                    default:
+                    }
+                    return false
+                }
+                return true
+            })
+            if err != nil || n != keys {
+                select {
+                case torn <- "read " + strconv.Itoa(n) + " keys":
+                default:
+                }
+                return
+            }
+        }
+    }()
+    wg.Wait()
+    close(done)
+    rg.Wait()
+    select {
+    case msg := <-torn:
+        t.Fatal("torn read: " + msg)
+    default:
+    }
+}
+
+func TestMemoryIteratorUnpositioned(t *testing.T) {
+    m := NewMemoryBackend()
+    if err := m.Put([]byte("a"), []byte("1")); err != nil {
+        t.Fatal(err)
+    }
+    it := m.NewIterator(nil)
+    if it.Prev() {
+        t.Fatal("Prev of an unpositioned iterator moved")
+    }
+    it.Release()
+    it = m.NewIterator(nil)
+    defer it.Release()
+    if !it.Next() || string(it.Key()) != "a" || it.Next() || !it.Prev() || string(it.Key()) != "a" {
+        t.Fatal("walk")
+    }
+}
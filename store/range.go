@@ -0,0 +1,90 @@
+package store
+
+import (
+    "bytes"
+    "github.com/syndtr/goleveldb/leveldb/iterator"
+    "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RangeOptions tune Range and RangePrefix. A nil *RangeOptions walks every
+// key forward and copies every value.
+type RangeOptions struct {
+    Reverse bool // walk from the last key to the first
+    Max     int  // stop after this many keys, unlimited when 0
+    // After resumes a previous walk: only keys after it, in walk order, are
+    // visited. Passing the last key seen pages through a range.
+    After    []byte
+    KeysOnly bool // pass nil values, saving the copy
+}
+
+func rangeOptions(opts []*RangeOptions) *RangeOptions {
+    if len(opts) > 0 && opts[0] != nil {
+        return opts[0]
+    }
+    return &RangeOptions{}
+}
+
+// iterate walks r inside the keyspace given by scope, hiding metadata and
+// expired keys. Keys are passed to fn without the scope prefix.
+func iterate(rd reader, scope []byte, r *util.Range, opt *RangeOptions, fn func(key []byte, value []byte) bool) error {
+    r = scopeRange(scope, resumeRange(r, opt))
+    if r == nil {
+        return nil
+    }
+    it := rd.NewIterator(r)
+    defer it.Release()
+    ttl := newTTLCursor(rd, opt.Reverse)
+    defer ttl.Release()
+    n := 0
+    for ok := first(it, opt.Reverse); ok; ok = next(it, opt.Reverse) {
+        if ttl.Expired(it.Key()) {
+            continue
+        }
+        var value []byte
+        if !opt.KeysOnly {
+            value = copyBytes(it.Value())
+        }
+        if !fn(copyBytes(it.Key()[len(scope):]), value) {
+            break
+        }
+        if n++; opt.Max > 0 && n >= opt.Max {
+            break
+        }
+    }
+    if err := ttl.Error(); err != nil {
+        return err
+    }
+    return it.Error()
+}
+
+// resumeRange narrows r to the keys after opt.After in walk order.
+func resumeRange(r *util.Range, opt *RangeOptions) *util.Range {
+    if opt.After == nil {
+        return r
+    }
+    start, limit := r.Start, r.Limit
+    if opt.Reverse {
+        if limit == nil || bytes.Compare(opt.After, limit) < 0 {
+            limit = opt.After
+        }
+    } else {
+        after := append(copyBytes(opt.After), 0)
+        if start == nil || bytes.Compare(after, start) > 0 {
+            start = after
+        }
+    }
+    return &util.Range{Start: start, Limit: limit}
+}
+
+func first(it iterator.Iterator, reverse bool) bool {
+    if reverse {
+        return it.Last()
+    }
+    return it.First()
+}
+func next(it iterator.Iterator, reverse bool) bool {
+    if reverse {
+        return it.Prev()
+    }
+    return it.Next()
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "io"
+    "sync"
+)
+
+var ErrSnapshotReleased = errors.New("store: snapshot released")
+
+// Snapshot is a read-only, point-in-time view of a Store. Writers are not
+// blocked while it is held, but it pins old data, so Release it when done.
+type Snapshot struct {
+    snap BackendSnapshot
+    seq  uint64
+
+    mu       sync.RWMutex
+    released bool
+}
+
+func (s *Store) Snapshot() (*Snapshot, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    snap, err := s.db.GetSnapshot()
+    if err != nil {
+        return nil, err
+    }
+    return &Snapshot{snap: snap, seq: s.seq}, nil
+}
+
+// Seq returns the sequence number of the last commit the snapshot includes;
+// watch events with a greater Seq happened after it.
+func (sn *Snapshot) Seq() uint64 {
+    return sn.seq
+}
+func (sn *Snapshot) Get(key []byte) ([]byte, error) {
+    key, err := scopeKey(nil, key)
+    if err != nil {
+        return nil, err
+    }
+    return sn.read(func(rd reader) ([]byte, error) {
+        return get(rd, key)
+    })
+}
+func (sn *Snapshot) Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    _, err := sn.read(func(rd reader) ([]byte, error) {
+        return nil, iterate(rd, nil, &util.Range{
+            Start: start,
+            Limit: limit,
+        }, rangeOptions(opts), fn)
+    })
+    return err
+}
+func (sn *Snapshot) RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    _, err := sn.read(func(rd reader) ([]byte, error) {
+        return nil, iterate(rd, nil, util.BytesPrefix(prefix), rangeOptions(opts), fn)
+    })
+    return err
+}
+
+// Dump writes the snapshot in the format of Store.Dump.
+func (sn *Snapshot) Dump(w io.Writer, opts ...*DumpOptions) error {
+    _, err := sn.read(func(rd reader) ([]byte, error) {
+        return nil, dump(rd, w, opts)
+    })
+    return err
+}
+
+// Release frees the snapshot. It is safe to call more than once.
+func (sn *Snapshot) Release() {
+    sn.mu.Lock()
+    defer sn.mu.Unlock()
+    if !sn.released {
+        sn.released = true
+        sn.snap.Release()
+    }
+}
+
+// read runs fn against the snapshot unless it has been released.
+func (sn *Snapshot) read(fn func(rd reader) ([]byte, error)) ([]byte, error) {
+    sn.mu.RLock()
+    defer sn.mu.RUnlock()
+    if sn.released {
+        return nil, ErrSnapshotReleased
+    }
+    return fn(sn.snap)
+}
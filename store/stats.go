@@ -0,0 +1,80 @@
+package store
+
+import (
+    "github.com/syndtr/goleveldb/leveldb"
+    "time"
+)
+
+type (
+    // Stats describes the state of a Store. The backend fields are left zero
+    // when the backend does not implement StatsBackend.
+    Stats struct {
+        Writes       uint64 // committed writes since the store was opened
+        Transactions int    // open read-write transactions
+        Watchers     int
+
+        DiskSize       int64 // bytes of the table files
+        MemorySize     int64 // bytes of the block cache, or of the data when held in memory
+        LevelSizes     []int64
+        LevelTables    []int
+        OpenedTables   int
+        AliveSnapshots int
+        AliveIterators int
+        IORead         uint64 // bytes read from disk
+        IOWrite        uint64 // bytes written to disk
+        WriteDelays    int
+        WriteDelay     time.Duration
+        WritePaused    bool
+    }
+    // StatsBackend is implemented by backends that report on their storage.
+    // Stats fills the backend fields of st.
+    StatsBackend interface {
+        Stats(st *Stats) error
+    }
+)
+
+// Stats reports on the transactions, watchers and storage of s.
+func (s *Store) Stats() (*Stats, error) {
+    s.mu.Lock()
+    st := &Stats{Writes: s.seq, Transactions: len(s.txs), Watchers: len(s.watchers)}
+    s.mu.Unlock()
+    if b, ok := s.db.(StatsBackend); ok {
+        if err := b.Stats(st); err != nil {
+            return nil, err
+        }
+    }
+    return st, nil
+}
+
+func (l *levelDB) Stats(st *Stats) error {
+    var ls leveldb.DBStats
+    if err := l.db.Stats(&ls); err != nil {
+        return err
+    }
+    for _, n := range ls.LevelSizes {
+        st.DiskSize += n
+    }
+    st.MemorySize = int64(ls.BlockCacheSize)
+    st.LevelSizes = ls.LevelSizes
+    st.LevelTables = ls.LevelTablesCounts
+    st.OpenedTables = ls.OpenedTablesCount
+    st.AliveSnapshots = int(ls.AliveSnapshots)
+    st.AliveIterators = int(ls.AliveIterators)
+    st.IORead = ls.IORead
+    st.IOWrite = ls.IOWrite
+    st.WriteDelays = int(ls.WriteDelayCount)
+    st.WriteDelay = ls.WriteDelayDuration
+    st.WritePaused = ls.WritePaused
+    return nil
+}
+func (m *memory) Stats(st *Stats) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    st.MemorySize = int64(m.db.Size())
+    for _, n := range m.snaps {
+        st.AliveSnapshots += n
+    }
+    st.AliveSnapshots -= m.iters
+    st.AliveIterators = m.iters
+    return nil
+}
@@ -1,16 +1,38 @@
 package store
 
 import (
-    "encoding/binary"
+    "bytes"
     "github.com/syndtr/goleveldb/leveldb"
     "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/iterator"
     "github.com/syndtr/goleveldb/leveldb/util"
-    "io"
+    "sync"
 )
 
+var (
+    ErrNotFound    = errors.ErrNotFound
+    ErrReservedKey = errors.New("store: key uses the reserved prefix")
+    ErrReadOnly    = errors.New("store: read-only")
+)
+
+// keys starting with sysPrefix hold store metadata and are hidden from callers
+var sysPrefix = []byte("\xff\xff")
+
 type (
     Store struct {
-        db *leveldb.DB
+        db Backend
+        mu sync.Mutex // serializes writers
+
+        seq       uint64            // number of committed writes
+        txs       map[*Tx]struct{}  // open read-write transactions
+        lastWrite map[string]uint64 // key -> seq of its last write, kept while txs is not empty
+        watchers  map[*Watcher]struct{}
+        indexes   map[string][]*index // scope -> registered indexes
+        readOnly  bool
+
+        closeOnce sync.Once
+        closeCh   chan struct{}
+        wg        sync.WaitGroup
     }
     Putter interface {
         Put(key []byte, value []byte)
@@ -18,62 +40,121 @@ type (
     Deleter interface {
         Delete([]byte)
     }
+    Options struct {
+        // InMemory keeps the data in memory instead of opening path.
+        InMemory bool
+        // Backend, when set, is used instead of opening path.
+        Backend Backend
+
+        // leveldb tuning, zero values keep the goleveldb defaults
+        BlockCacheCapacity     int  // bytes of the block cache, 8MiB by default
+        WriteBuffer            int  // bytes of the memtable, 4MiB by default
+        OpenFilesCacheCapacity int  // open table files, 500 by default
+        BloomFilterBits        int  // bits per key of a bloom filter, disabled when 0
+        DisableCompression     bool // store table blocks uncompressed instead of snappy
+
+        // Sync flushes every write to disk before it returns, so that no
+        // acknowledged write is lost on a machine crash.
+        Sync bool
+        // ErrorIfMissing fails to open a store that does not exist yet.
+        ErrorIfMissing bool
+        // ReadOnly opens the store without ever writing to it: all writes
+        // fail with ErrReadOnly and expired keys are only hidden, not reaped.
+        ReadOnly bool
+    }
+    // reader is implemented by Backend and BackendSnapshot.
+    reader interface {
+        Get(key []byte) ([]byte, error)
+        Has(key []byte) (bool, error)
+        NewIterator(r *util.Range) iterator.Iterator
+    }
 )
 
-func New(path string) (*Store, error) {
-    db, err := leveldb.OpenFile(path, nil)
+func New(path string, opts ...*Options) (*Store, error) {
+    opt := &Options{}
+    if len(opts) > 0 && opts[0] != nil {
+        opt = opts[0]
+    }
+    var (
+        db  Backend
+        err error
+    )
+    switch {
+    case opt.Backend != nil:
+        db = opt.Backend
+    case opt.InMemory:
+        db = NewMemoryBackend()
+    default:
+        db, err = OpenLevelDB(path, opt)
+    }
     if err != nil {
         return nil, err
     }
     s := &Store{
-        db: db,
+        db:        db,
+        txs:       make(map[*Tx]struct{}),
+        lastWrite: make(map[string]uint64),
+        watchers:  make(map[*Watcher]struct{}),
+        indexes:   make(map[string][]*index),
+        readOnly:  opt.ReadOnly,
+        closeCh:   make(chan struct{}),
+    }
+    if !s.readOnly {
+        s.wg.Add(1)
+        go s.reap()
     }
     return s, nil
 }
 func (s *Store) Close() error {
+    s.closeOnce.Do(func() {
+        close(s.closeCh)
+        s.mu.Lock()
+        for w := range s.watchers {
+            w.stop(ErrClosed)
+        }
+        s.mu.Unlock()
+    })
+    s.wg.Wait()
     return s.db.Close()
 }
 func (s *Store) Get(key []byte) (result []byte, err error) {
-    return s.db.Get(key, nil)
+    return s.get(nil, key)
 }
 func (s *Store) Put(key, value []byte) error {
-    return s.db.Put(key, value, nil)
+    return s.batch(nil, func(b scopedBatch) {
+        b.Put(key, value)
+    })
 }
 func (s *Store) Del(key []byte) error {
-    return s.db.Delete(key, nil)
+    return s.batch(nil, func(b scopedBatch) {
+        b.Delete(key)
+    })
 }
 func (s *Store) BatchPut(fn func(putter Putter)) error {
-    batch := new(leveldb.Batch)
-    fn(batch)
-    return s.db.Write(batch, nil)
+    return s.batch(nil, func(b scopedBatch) {
+        fn(b)
+    })
 }
 func (s *Store) BatchDel(fn func(del Deleter)) error {
-    batch := new(leveldb.Batch)
-    fn(batch)
-    return s.db.Write(batch, nil)
+    return s.batch(nil, func(b scopedBatch) {
+        fn(b)
+    })
 }
-func (s *Store) Range(start, limit []byte, fn func(key []byte, value []byte) bool) error {
-    it := s.db.NewIterator(&util.Range{
+func (s *Store) Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return iterate(s.db, nil, &util.Range{
         Start: start,
         Limit: limit,
-    }, nil)
-    defer it.Release()
-    for it.Next() {
-        if !fn(copyBytes(it.Key()), copyBytes(it.Value())) {
-            break
-        }
-    }
-    return it.Error()
+    }, rangeOptions(opts), fn)
 }
-func (s *Store) RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool) error {
-    it := s.db.NewIterator(util.BytesPrefix(prefix), nil)
-    defer it.Release()
-    for it.Next() {
-        if !fn(copyBytes(it.Key()), copyBytes(it.Value())) {
-            break
-        }
-    }
-    return it.Error()
+func (s *Store) RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return iterate(s.db, nil, util.BytesPrefix(prefix), rangeOptions(opts), fn)
+}
+
+// DeleteRange deletes every key of [start, limit), nil bounds standing for
+// the ends of the keyspace, and compacts the range they occupied. Keys are
+// deleted in batches, so readers may see part of the range gone.
+func (s *Store) DeleteRange(start, limit []byte) error {
+    return s.deleteRange(nil, &util.Range{Start: start, Limit: limit})
 }
 func (s *Store) GC(args ...[]byte) error {
     var (
@@ -89,70 +170,178 @@ func (s *Store) GC(args ...[]byte) error {
         Limit: limit,
     })
 }
-func (s *Store) Dump(w io.Writer) error {
-    shot, err := s.db.GetSnapshot()
+func (s *Store) get(scope, key []byte) ([]byte, error) {
+    key, err := scopeKey(scope, key)
     if err != nil {
-        return err
+        return nil, err
     }
-    defer shot.Release()
-    it := shot.NewIterator(nil, nil)
-    defer it.Release()
-    for it.Next() {
-        k := it.Key()
-        v := it.Value()
-        header := make([]byte, 8)
-        binary.BigEndian.PutUint32(header, uint32(len(k)))
-        binary.BigEndian.PutUint32(header[4:], uint32(len(v)))
-        if _, err := w.Write(header); err != nil {
-            return err
-        }
-        if _, err := w.Write(k); err != nil {
+    return get(s.db, key)
+}
+func (s *Store) batch(scope []byte, fn func(b scopedBatch)) error {
+    b := new(writeBatch)
+    fn(scopedBatch{b: b, scope: scope})
+    return s.write(b)
+}
+func (s *Store) write(b *writeBatch) error {
+    if b.err != nil {
+        return b.err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.writeLocked(b)
+}
+func (s *Store) writeLocked(b *writeBatch) error {
+    if b.err != nil {
+        return b.err
+    }
+    if s.readOnly {
+        return ErrReadOnly
+    }
+    if len(s.indexes) > 0 {
+        if err := s.updateIndexes(b); err != nil {
             return err
         }
-        if _, err := w.Write(v); err != nil {
-            return err
+    }
+    if err := s.db.Write(&b.batch); err != nil {
+        return err
+    }
+    s.seq++
+    if len(s.txs) > 0 {
+        for _, c := range b.changes {
+            s.lastWrite[string(c.key)] = s.seq
         }
     }
+    s.notify(b.changes)
     return nil
 }
-func (s *Store) Load(r io.Reader) error {
-    var err error
-    for {
-        header := make([]byte, 8)
-        if err = mustRead(r, header); err != nil {
-            break
-        }
 
-        ks := binary.BigEndian.Uint32(header)
-        vs := binary.BigEndian.Uint32(header[4:])
+// get reads a user key from rd, treating expired keys as missing.
+func get(rd reader, key []byte) ([]byte, error) {
+    value, err := rd.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    if isExpired(rd, key) {
+        return nil, ErrNotFound
+    }
+    return value, nil
+}
 
-        k := make([]byte, ks)
-        v := make([]byte, vs)
-        if err = mustRead(r, k); err != nil {
-            break
-        }
-        if err = mustRead(r, v); err != nil {
-            break
-        }
-        if err = s.db.Put(k, v, nil); err != nil {
-            break
+// writeBatch collects writes to full keys. Plain puts and deletes also drop
+// the expiry of the key, matching the behaviour of Put and Del.
+type writeBatch struct {
+    batch   leveldb.Batch
+    changes []change // writes to data keys, in batch order
+    err     error
+}
+
+// change records a write to a data key. Metadata-only changes, such as a new
+// ttl, have a zero typ and are not reported to watchers.
+type change struct {
+    typ   EventType
+    key   []byte
+    value []byte
+}
+
+func (b *writeBatch) put(key, value []byte) {
+    b.batch.Put(key, value)
+    b.batch.Delete(ttlKey(key))
+    b.changes = append(b.changes, change{typ: EventPut, key: key, value: value})
+}
+
+// putKeepTTL writes key without touching its expiry.
+func (b *writeBatch) putKeepTTL(key, value []byte) {
+    b.batch.Put(key, value)
+    b.changes = append(b.changes, change{typ: EventPut, key: key, value: value})
+}
+func (b *writeBatch) del(key []byte) {
+    b.batch.Delete(key)
+    b.batch.Delete(ttlKey(key))
+    b.changes = append(b.changes, change{typ: EventDelete, key: key})
+}
+
+// putRaw and deleteRaw write any key as is, metadata included.
+func (b *writeBatch) putRaw(key, value []byte) {
+    b.batch.Put(key, value)
+    if isDataKey(key) {
+        b.changes = append(b.changes, change{typ: EventPut, key: key, value: value})
+    }
+}
+func (b *writeBatch) deleteRaw(key []byte) {
+    b.batch.Delete(key)
+    if isDataKey(key) {
+        b.changes = append(b.changes, change{typ: EventDelete, key: key})
+    }
+}
+
+// scopedBatch is the Putter and Deleter handed to callers. It maps their
+// keys into the keyspace given by scope.
+type scopedBatch struct {
+    b     *writeBatch
+    scope []byte
+}
+
+func (w scopedBatch) Put(key, value []byte) {
+    if key, err := scopeKey(w.scope, key); err != nil {
+        w.b.err = err
+    } else {
+        w.b.put(key, value)
+    }
+}
+func (w scopedBatch) Delete(key []byte) {
+    if key, err := scopeKey(w.scope, key); err != nil {
+        w.b.err = err
+    } else {
+        w.b.del(key)
+    }
+}
+
+// A scope selects a keyspace: nil is the root keyspace of the Store, any
+// other value is the key prefix of a Bucket.
+
+func scopeKey(scope, key []byte) ([]byte, error) {
+    if scope == nil {
+        if isSysKey(key) {
+            return nil, ErrReservedKey
         }
+        return key, nil
+    }
+    return append(append(make([]byte, 0, len(scope)+len(key)), scope...), key...), nil
+}
+
+// scopeRange maps r into scope. It returns nil when nothing of r is left.
+func scopeRange(scope []byte, r *util.Range) *util.Range {
+    if scope == nil {
+        return userRange(r)
+    }
+    full := util.BytesPrefix(scope)
+    if r.Start != nil {
+        full.Start, _ = scopeKey(scope, r.Start)
     }
-    if err == io.EOF {
-        err = nil
+    if r.Limit != nil {
+        full.Limit, _ = scopeKey(scope, r.Limit)
     }
-    return err
+    if bytes.Compare(full.Start, full.Limit) >= 0 {
+        return nil
+    }
+    return full
 }
-func mustRead(r io.Reader, buf []byte) error {
-    sz := len(buf)
-    n, err := io.ReadFull(r, buf)
-    if err != nil {
-        return err
+
+func isSysKey(key []byte) bool {
+    return bytes.HasPrefix(key, sysPrefix)
+}
+
+// userRange clamps r so that it never reaches into the metadata keyspace.
+// It returns nil when nothing of r is left.
+func userRange(r *util.Range) *util.Range {
+    start, limit := r.Start, r.Limit
+    if limit == nil || bytes.Compare(limit, sysPrefix) > 0 {
+        limit = sysPrefix
     }
-    if n != sz {
-        return errors.New("invalid read")
+    if start != nil && bytes.Compare(start, limit) >= 0 {
+        return nil
     }
-    return nil
+    return &util.Range{Start: start, Limit: limit}
 }
 func copyBytes(data []byte) []byte {
     result := make([]byte, len(data))
@@ -0,0 +1,274 @@
+package store
+
+import (
+    "bytes"
+    "encoding/binary"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/iterator"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "time"
+)
+
+// NoTTL is returned by TTL for keys that never expire.
+const NoTTL time.Duration = -1
+
+var ErrInvalidTTL = errors.New("store: ttl must be positive")
+
+// Expiry metadata lives next to the data in the reserved keyspace:
+//
+//    ttlPrefix + key                  -> expire time (unix nano, big endian)
+//    expiryPrefix + expire time + key -> empty, ordered by expire time for the reaper
+//
+// Entries of the expiry index may be stale; the reaper only deletes a key when
+// its ttl entry still carries the indexed time.
+var (
+    ttlPrefix    = []byte("\xff\xfft")
+    expiryPrefix = []byte("\xff\xffx")
+)
+
+const (
+    reapInterval = time.Second
+    reapBatch    = 256
+)
+
+func (s *Store) PutWithTTL(key, value []byte, ttl time.Duration) error {
+    return s.putWithTTL(nil, key, value, ttl)
+}
+
+// Expire sets the ttl of an existing key. A ttl <= 0 deletes the key.
+func (s *Store) Expire(key []byte, ttl time.Duration) error {
+    return s.expire(nil, key, ttl)
+}
+
+// TTL returns the remaining time to live of key, or NoTTL when it has none.
+func (s *Store) TTL(key []byte) (time.Duration, error) {
+    return s.ttl(nil, key)
+}
+
+// Persist removes the ttl of key.
+func (s *Store) Persist(key []byte) error {
+    return s.persist(nil, key)
+}
+
+func (s *Store) putWithTTL(scope, key, value []byte, ttl time.Duration) error {
+    if ttl <= 0 {
+        return ErrInvalidTTL
+    }
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    b := new(writeBatch)
+    b.put(key, value)
+    b.expireAt(key, time.Now().Add(ttl))
+    return s.write(b)
+}
+func (s *Store) expire(scope, key []byte, ttl time.Duration) error {
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := get(s.db, key); err != nil {
+        return err
+    }
+    b := new(writeBatch)
+    if ttl <= 0 {
+        b.del(key)
+    } else {
+        b.expireAt(key, time.Now().Add(ttl))
+    }
+    return s.writeLocked(b)
+}
+func (s *Store) ttl(scope, key []byte) (time.Duration, error) {
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return 0, err
+    }
+    if ok, err := s.db.Has(key); err != nil {
+        return 0, err
+    } else if !ok {
+        return 0, ErrNotFound
+    }
+    at, ok, err := expireTime(s.db, key)
+    if err != nil {
+        return 0, err
+    }
+    if !ok {
+        return NoTTL, nil
+    }
+    ttl := time.Until(at)
+    if ttl <= 0 {
+        return 0, ErrNotFound
+    }
+    return ttl, nil
+}
+func (s *Store) persist(scope, key []byte) error {
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := get(s.db, key); err != nil {
+        return err
+    }
+    b := new(writeBatch)
+    b.persist(key)
+    return s.writeLocked(b)
+}
+
+func expireTime(rd reader, key []byte) (time.Time, bool, error) {
+    data, err := rd.Get(ttlKey(key))
+    if err == ErrNotFound {
+        return time.Time{}, false, nil
+    }
+    if err != nil {
+        return time.Time{}, false, err
+    }
+    return decodeTime(data), true, nil
+}
+func isExpired(rd reader, key []byte) bool {
+    at, ok, err := expireTime(rd, key)
+    return err == nil && ok && !at.After(time.Now())
+}
+
+// reap periodically deletes expired keys until the store is closed.
+func (s *Store) reap() {
+    defer s.wg.Done()
+    ticker := time.NewTicker(reapInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.closeCh:
+            return
+        case <-ticker.C:
+            for {
+                n, err := s.reapOnce(time.Now())
+                if err != nil || n < reapBatch {
+                    break
+                }
+            }
+        }
+    }
+}
+
+// reapOnce deletes up to reapBatch keys that expired before now.
+func (s *Store) reapOnce(now time.Time) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    it := s.db.NewIterator(&util.Range{
+        Start: expiryPrefix,
+        Limit: expiryKey(now, nil),
+    })
+    defer it.Release()
+
+    var (
+        b = new(writeBatch)
+        n int
+    )
+    for n < reapBatch && it.Next() {
+        n++
+        indexKey := it.Key()
+        at := indexKey[len(expiryPrefix) : len(expiryPrefix)+8]
+        key := indexKey[len(expiryPrefix)+8:]
+        b.batch.Delete(indexKey)
+        current, err := s.db.Get(ttlKey(key))
+        if err == nil && bytes.Equal(current, at) {
+            b.batch.Delete(key)
+            b.batch.Delete(ttlKey(key))
+            b.changes = append(b.changes, change{typ: EventExpire, key: copyBytes(key)})
+        }
+    }
+    if err := it.Error(); err != nil {
+        return n, err
+    }
+    if n == 0 {
+        return 0, nil
+    }
+    return n, s.writeLocked(b)
+}
+
+func (b *writeBatch) expireAt(key []byte, at time.Time) {
+    b.batch.Put(ttlKey(key), encodeTime(at))
+    b.batch.Put(expiryKey(at, key), nil)
+    b.changes = append(b.changes, change{key: key})
+}
+
+func (b *writeBatch) persist(key []byte) {
+    b.batch.Delete(ttlKey(key))
+    b.changes = append(b.changes, change{key: key})
+}
+
+// ttlCursor answers expiry lookups for keys visited in order, ascending or
+// descending, with a single iterator over the ttl metadata.
+type ttlCursor struct {
+    it      iterator.Iterator
+    now     time.Time
+    key     []byte
+    reverse bool
+    done    bool
+}
+
+func newTTLCursor(rd reader, reverse bool) *ttlCursor {
+    return &ttlCursor{
+        it:      rd.NewIterator(util.BytesPrefix(ttlPrefix)),
+        now:     time.Now(),
+        reverse: reverse,
+    }
+}
+func (c *ttlCursor) Expired(key []byte) bool {
+    if c.done {
+        return false
+    }
+    c.key = append(append(c.key[:0], ttlPrefix...), key...)
+    if c.reverse {
+        if !c.it.Valid() && !c.it.Seek(c.key) && !c.it.Last() {
+            c.done = true
+            return false
+        }
+        for bytes.Compare(c.it.Key(), c.key) > 0 {
+            if !c.it.Prev() {
+                c.done = true
+                return false
+            }
+        }
+    } else if !c.it.Valid() || bytes.Compare(c.it.Key(), c.key) < 0 {
+        if !c.it.Seek(c.key) {
+            c.done = true
+            return false
+        }
+    }
+    if !bytes.Equal(c.it.Key(), c.key) {
+        return false
+    }
+    return !decodeTime(c.it.Value()).After(c.now)
+}
+func (c *ttlCursor) Error() error {
+    return c.it.Error()
+}
+func (c *ttlCursor) Release() {
+    c.it.Release()
+}
+
+func ttlKey(key []byte) []byte {
+    return append(append(make([]byte, 0, len(ttlPrefix)+len(key)), ttlPrefix...), key...)
+}
+func expiryKey(at time.Time, key []byte) []byte {
+    buf := make([]byte, 0, len(expiryPrefix)+8+len(key))
+    buf = append(buf, expiryPrefix...)
+    buf = append(buf, encodeTime(at)...)
+    return append(buf, key...)
+}
+func encodeTime(t time.Time) []byte {
+    buf := make([]byte, 8)
+    binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+    return buf
+}
+func decodeTime(data []byte) time.Time {
+    if len(data) != 8 {
+        return time.Time{}
+    }
+    return time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+}
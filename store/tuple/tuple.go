@@ -0,0 +1,230 @@
+// Package tuple encodes composite keys so that they sort element by element,
+// modelled on the FoundationDB tuple layer.
+package tuple
+
+import (
+    "encoding/binary"
+    "fmt"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "math"
+    "time"
+)
+
+var ErrInvalid = errors.New("tuple: malformed encoding")
+
+// Tuple is a composite key. Its encoding sorts element by element, so the
+// tuples starting with the same elements are stored next to each other, and
+// signed numbers and strings of any length keep their natural order.
+//
+// Elements may be nil, []byte, string, bool, any integer, float32, float64 or
+// time.Time. Integers decode as int64, or uint64 when too large, float32 as
+// float64.
+type Tuple []interface{}
+
+const (
+    codeNil    = 0x00
+    codeBytes  = 0x01
+    codeString = 0x02
+    codeInt    = 0x14 // zero; 0x14 ± n for n bytes of magnitude
+    codeFloat  = 0x21
+    codeFalse  = 0x26
+    codeTrue   = 0x27
+    codeTime   = 0x30
+)
+
+// Pack encodes t.
+func Pack(t Tuple) ([]byte, error) {
+    var buf []byte
+    for _, e := range t {
+        switch v := e.(type) {
+        case nil:
+            buf = append(buf, codeNil)
+        case []byte:
+            buf = appendBytes(append(buf, codeBytes), v)
+        case string:
+            buf = appendBytes(append(buf, codeString), []byte(v))
+        case bool:
+            if v {
+                buf = append(buf, codeTrue)
+            } else {
+                buf = append(buf, codeFalse)
+            }
+        case int:
+            buf = appendInt(buf, int64(v))
+        case int8:
+            buf = appendInt(buf, int64(v))
+        case int16:
+            buf = appendInt(buf, int64(v))
+        case int32:
+            buf = appendInt(buf, int64(v))
+        case int64:
+            buf = appendInt(buf, v)
+        case uint:
+            buf = appendUint(buf, uint64(v))
+        case uint8:
+            buf = appendUint(buf, uint64(v))
+        case uint16:
+            buf = appendUint(buf, uint64(v))
+        case uint32:
+            buf = appendUint(buf, uint64(v))
+        case uint64:
+            buf = appendUint(buf, v)
+        case float32:
+            buf = appendFloat(buf, float64(v))
+        case float64:
+            buf = appendFloat(buf, v)
+        case time.Time:
+            buf = appendUint64(append(buf, codeTime), uint64(v.UnixNano())^1<<63)
+        default:
+            return nil, fmt.Errorf("tuple: unsupported element %T", e)
+        }
+    }
+    return buf, nil
+}
+
+// Unpack decodes a key encoded by Pack.
+func Unpack(data []byte) (Tuple, error) {
+    t := Tuple{}
+    for len(data) > 0 {
+        code := data[0]
+        data = data[1:]
+        switch {
+        case code == codeNil:
+            t = append(t, nil)
+        case code == codeBytes || code == codeString:
+            v, rest, ok := splitBytes(data)
+            if !ok {
+                return nil, ErrInvalid
+            }
+            if code == codeString {
+                t = append(t, string(v))
+            } else {
+                t = append(t, v)
+            }
+            data = rest
+        case code == codeFalse || code == codeTrue:
+            t = append(t, code == codeTrue)
+        case code >= codeInt-8 && code <= codeInt+8:
+            n := int(code) - codeInt
+            negative := n < 0
+            if negative {
+                n = -n
+            }
+            if len(data) < n {
+                return nil, ErrInvalid
+            }
+            var u uint64
+            for _, c := range data[:n] {
+                u = u<<8 | uint64(c)
+            }
+            data = data[n:]
+            switch {
+            case negative:
+                u = ^u
+                if n < 8 {
+                    u &= 1<<(8*n) - 1
+                }
+                t = append(t, -int64(u))
+            case u > math.MaxInt64:
+                t = append(t, u)
+            default:
+                t = append(t, int64(u))
+            }
+        case code == codeFloat || code == codeTime:
+            if len(data) < 8 {
+                return nil, ErrInvalid
+            }
+            u := binary.BigEndian.Uint64(data)
+            data = data[8:]
+            if code == codeTime {
+                t = append(t, time.Unix(0, int64(u^1<<63)))
+            } else if u&(1<<63) != 0 {
+                t = append(t, math.Float64frombits(u^1<<63))
+            } else {
+                t = append(t, math.Float64frombits(^u))
+            }
+        default:
+            return nil, ErrInvalid
+        }
+    }
+    return t, nil
+}
+
+// Range returns the bounds of the keys of the tuples that start with prefix
+// and are longer than it, ready to be passed to Store.Range.
+func Range(prefix Tuple) (start, limit []byte, err error) {
+    p, err := Pack(prefix)
+    if err != nil {
+        return nil, nil, err
+    }
+    return append(p, 0x00), append(p[:len(p):len(p)], 0xff), nil
+}
+
+// appendBytes appends v with 0x00 escaped as 0x00 0xff, then 0x00.
+func appendBytes(buf, v []byte) []byte {
+    for _, c := range v {
+        buf = append(buf, c)
+        if c == 0 {
+            buf = append(buf, 0xff)
+        }
+    }
+    return append(buf, 0)
+}
+func splitBytes(data []byte) ([]byte, []byte, bool) {
+    v := []byte{}
+    for i := 0; i < len(data); i++ {
+        if data[i] != 0 {
+            v = append(v, data[i])
+        } else if i+1 < len(data) && data[i+1] == 0xff {
+            v = append(v, 0)
+            i++
+        } else {
+            return v, data[i+1:], true
+        }
+    }
+    return nil, nil, false
+}
+func appendInt(buf []byte, v int64) []byte {
+    if v >= 0 {
+        return appendUint(buf, uint64(v))
+    }
+    u := uint64(-v)
+    n := intLen(u)
+    u = ^u
+    buf = append(buf, byte(codeInt-n))
+    for i := n - 1; i >= 0; i-- {
+        buf = append(buf, byte(u>>(8*i)))
+    }
+    return buf
+}
+func appendUint(buf []byte, u uint64) []byte {
+    n := intLen(u)
+    buf = append(buf, byte(codeInt+n))
+    for i := n - 1; i >= 0; i-- {
+        buf = append(buf, byte(u>>(8*i)))
+    }
+    return buf
+}
+
+// intLen returns the number of bytes of u without leading zeros.
+func intLen(u uint64) int {
+    n := 0
+    for ; u > 0; u >>= 8 {
+        n++
+    }
+    return n
+}
+func appendFloat(buf []byte, f float64) []byte {
+    u := math.Float64bits(f)
+    if u&(1<<63) != 0 {
+        u = ^u
+    } else {
+        u ^= 1 << 63
+    }
+    return appendUint64(append(buf, codeFloat), u)
+}
+func appendUint64(buf []byte, u uint64) []byte {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], u)
+    return append(buf, b[:]...)
+}
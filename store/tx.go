@@ -0,0 +1,463 @@
+package store
+
+import (
+    "bytes"
+    "github.com/syndtr/goleveldb/leveldb/comparer"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+    "github.com/syndtr/goleveldb/leveldb/memdb"
+    "github.com/syndtr/goleveldb/leveldb/util"
+    "time"
+)
+
+var (
+    ErrConflict   = errors.New("store: transaction conflict")
+    ErrTxReadOnly = errors.New("store: transaction is read-only")
+    ErrTxClosed   = errors.New("store: transaction is closed")
+)
+
+// lastWrite is pruned once it grows beyond this many keys.
+const lastWritePrune = 4096
+
+const (
+    pendingDel byte = iota
+    pendingPut
+    pendingPutKeepTTL
+)
+
+// Tx reads from a snapshot taken when it began and buffers its writes until
+// commit. A read-write Tx fails to commit with ErrConflict when any key it
+// read was written by someone else in the meantime.
+type Tx struct {
+    s        *Store
+    snap     BackendSnapshot
+    seq      uint64
+    writable bool
+    closed   bool
+
+    reads   map[string]struct{}
+    pending *memdb.DB            // key -> pendingPut(KeepTTL) + value | pendingDel
+    expires map[string]time.Time // key -> new expire time, zero to persist
+}
+
+// Update runs fn in a read-write transaction and commits it when fn
+// returns nil.
+func (s *Store) Update(fn func(tx *Tx) error) error {
+    tx, err := s.begin(true)
+    if err != nil {
+        return err
+    }
+    defer tx.discard()
+    if err := fn(tx); err != nil {
+        return err
+    }
+    return tx.commit()
+}
+
+// View runs fn in a read-only transaction.
+func (s *Store) View(fn func(tx *Tx) error) error {
+    tx, err := s.begin(false)
+    if err != nil {
+        return err
+    }
+    defer tx.discard()
+    return fn(tx)
+}
+
+func (s *Store) begin(writable bool) (*Tx, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    snap, err := s.db.GetSnapshot()
+    if err != nil {
+        return nil, err
+    }
+    tx := &Tx{
+        s:        s,
+        snap:     snap,
+        seq:      s.seq,
+        writable: writable,
+    }
+    if writable {
+        tx.reads = make(map[string]struct{})
+        tx.pending = memdb.New(comparer.DefaultComparer, 0)
+        tx.expires = make(map[string]time.Time)
+        s.txs[tx] = struct{}{}
+    }
+    return tx, nil
+}
+
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+    return tx.get(nil, key)
+}
+func (tx *Tx) Put(key, value []byte) error {
+    return tx.put(nil, key, value)
+}
+func (tx *Tx) Del(key []byte) error {
+    return tx.del(nil, key)
+}
+func (tx *Tx) PutWithTTL(key, value []byte, ttl time.Duration) error {
+    return tx.putWithTTL(nil, key, value, ttl)
+}
+
+// PutKeepTTL writes key without touching its ttl, like the increments of
+// Store do.
+func (tx *Tx) PutKeepTTL(key, value []byte) error {
+    return tx.putOp(nil, key, value, pendingPutKeepTTL)
+}
+
+// Expire sets the ttl of an existing key. A ttl <= 0 deletes the key.
+func (tx *Tx) Expire(key []byte, ttl time.Duration) error {
+    return tx.expire(nil, key, ttl)
+}
+func (tx *Tx) TTL(key []byte) (time.Duration, error) {
+    return tx.ttl(nil, key)
+}
+func (tx *Tx) Persist(key []byte) error {
+    return tx.persist(nil, key)
+}
+
+// Expired reports whether key outlived its ttl and awaits the reaper. Such a
+// key reads as missing, but is still stored.
+func (tx *Tx) Expired(key []byte) (bool, error) {
+    return tx.expired(nil, key)
+}
+
+// Range walks [start, limit) as seen by the transaction, including its own
+// uncommitted writes.
+func (tx *Tx) Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return tx.iterate(nil, &util.Range{
+        Start: start,
+        Limit: limit,
+    }, rangeOptions(opts), fn)
+}
+func (tx *Tx) RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return tx.iterate(nil, util.BytesPrefix(prefix), rangeOptions(opts), fn)
+}
+
+// Bucket returns the view of b inside the transaction.
+func (tx *Tx) Bucket(b *Bucket) *TxBucket {
+    return &TxBucket{tx: tx, scope: b.scope}
+}
+
+// TxBucket is a Bucket as seen by a transaction.
+type TxBucket struct {
+    tx    *Tx
+    scope []byte
+}
+
+func (b *TxBucket) Get(key []byte) ([]byte, error) {
+    return b.tx.get(b.scope, key)
+}
+func (b *TxBucket) Put(key, value []byte) error {
+    return b.tx.put(b.scope, key, value)
+}
+func (b *TxBucket) Del(key []byte) error {
+    return b.tx.del(b.scope, key)
+}
+func (b *TxBucket) PutWithTTL(key, value []byte, ttl time.Duration) error {
+    return b.tx.putWithTTL(b.scope, key, value, ttl)
+}
+func (b *TxBucket) PutKeepTTL(key, value []byte) error {
+    return b.tx.putOp(b.scope, key, value, pendingPutKeepTTL)
+}
+func (b *TxBucket) Expire(key []byte, ttl time.Duration) error {
+    return b.tx.expire(b.scope, key, ttl)
+}
+func (b *TxBucket) TTL(key []byte) (time.Duration, error) {
+    return b.tx.ttl(b.scope, key)
+}
+func (b *TxBucket) Persist(key []byte) error {
+    return b.tx.persist(b.scope, key)
+}
+func (b *TxBucket) Expired(key []byte) (bool, error) {
+    return b.tx.expired(b.scope, key)
+}
+func (b *TxBucket) Range(start, limit []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return b.tx.iterate(b.scope, &util.Range{
+        Start: start,
+        Limit: limit,
+    }, rangeOptions(opts), fn)
+}
+func (b *TxBucket) RangePrefix(prefix []byte, fn func(key []byte, value []byte) bool, opts ...*RangeOptions) error {
+    return b.tx.iterate(b.scope, util.BytesPrefix(prefix), rangeOptions(opts), fn)
+}
+
+func (tx *Tx) get(scope, key []byte) ([]byte, error) {
+    if tx.closed {
+        return nil, ErrTxClosed
+    }
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return nil, err
+    }
+    if tx.writable {
+        if op, err := tx.pending.Get(key); err == nil {
+            if op[0] == pendingDel {
+                return nil, ErrNotFound
+            }
+            return copyBytes(op[1:]), nil
+        }
+        tx.reads[string(key)] = struct{}{}
+    }
+    return get(tx.snap, key)
+}
+func (tx *Tx) put(scope, key, value []byte) error {
+    return tx.putOp(scope, key, value, pendingPut)
+}
+func (tx *Tx) putOp(scope, key, value []byte, kind byte) error {
+    key, err := tx.writeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    switch kind {
+    case pendingPut:
+        delete(tx.expires, string(key))
+    case pendingPutKeepTTL:
+        // there is no ttl to keep after a put or delete earlier in the
+        // transaction, or once the key expired: keep the one set by the put
+        if op, err := tx.pending.Get(key); err == nil {
+            if op[0] != pendingPutKeepTTL {
+                kind = pendingPut
+            }
+        } else if isExpired(tx.snap, key) {
+            kind = pendingPut
+        }
+    }
+    op := make([]byte, 1+len(value))
+    op[0] = kind
+    copy(op[1:], value)
+    return tx.pending.Put(key, op)
+}
+func (tx *Tx) del(scope, key []byte) error {
+    key, err := tx.writeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    delete(tx.expires, string(key))
+    return tx.pending.Put(key, []byte{pendingDel})
+}
+func (tx *Tx) putWithTTL(scope, key, value []byte, ttl time.Duration) error {
+    if ttl <= 0 {
+        return ErrInvalidTTL
+    }
+    if err := tx.put(scope, key, value); err != nil {
+        return err
+    }
+    key, _ = scopeKey(scope, key)
+    tx.expires[string(key)] = time.Now().Add(ttl)
+    return nil
+}
+func (tx *Tx) expire(scope, key []byte, ttl time.Duration) error {
+    if _, err := tx.get(scope, key); err != nil {
+        return err
+    }
+    if ttl <= 0 {
+        return tx.del(scope, key)
+    }
+    key, err := tx.writeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    tx.expires[string(key)] = time.Now().Add(ttl)
+    return nil
+}
+func (tx *Tx) ttl(scope, key []byte) (time.Duration, error) {
+    if _, err := tx.get(scope, key); err != nil {
+        return 0, err
+    }
+    key, _ = scopeKey(scope, key)
+    at, ok := time.Time{}, false
+    if tx.writable {
+        at, ok = tx.expires[string(key)]
+    }
+    if !ok {
+        if tx.writable {
+            if op, err := tx.pending.Get(key); err == nil && op[0] == pendingPut {
+                return NoTTL, nil
+            }
+        }
+        var err error
+        if at, ok, err = expireTime(tx.snap, key); err != nil {
+            return 0, err
+        }
+    }
+    if !ok || at.IsZero() {
+        return NoTTL, nil
+    }
+    ttl := time.Until(at)
+    if ttl <= 0 {
+        return 0, ErrNotFound
+    }
+    return ttl, nil
+}
+func (tx *Tx) expired(scope, key []byte) (bool, error) {
+    if tx.closed {
+        return false, ErrTxClosed
+    }
+    key, err := scopeKey(scope, key)
+    if err != nil {
+        return false, err
+    }
+    if tx.writable {
+        if _, err := tx.pending.Get(key); err == nil {
+            return false, nil
+        }
+        tx.reads[string(key)] = struct{}{}
+    }
+    if ok, err := tx.snap.Has(key); err != nil || !ok {
+        return false, err
+    }
+    return isExpired(tx.snap, key), nil
+}
+func (tx *Tx) persist(scope, key []byte) error {
+    if _, err := tx.get(scope, key); err != nil {
+        return err
+    }
+    key, err := tx.writeKey(scope, key)
+    if err != nil {
+        return err
+    }
+    tx.expires[string(key)] = time.Time{}
+    return nil
+}
+
+func (tx *Tx) iterate(scope []byte, r *util.Range, opt *RangeOptions, fn func(key []byte, value []byte) bool) error {
+    if tx.closed {
+        return ErrTxClosed
+    }
+    if !tx.writable {
+        return iterate(tx.snap, scope, r, opt, fn)
+    }
+    r = resumeRange(r, opt)
+    full := scopeRange(scope, r)
+    if full == nil {
+        return nil
+    }
+    // before reports whether a comes before b in walk order.
+    before := func(a, b []byte) bool {
+        if opt.Reverse {
+            return bytes.Compare(a, b) > 0
+        }
+        return bytes.Compare(a, b) < 0
+    }
+    n := 0
+    stopped := false
+    yield := func(key, value []byte) bool {
+        if opt.KeysOnly {
+            value = nil
+        }
+        n++
+        stopped = !fn(key, value) || (opt.Max > 0 && n >= opt.Max)
+        return !stopped
+    }
+    // pending keys are full keys, compared and passed on without the scope
+    pit := tx.pending.NewIterator(full)
+    defer pit.Release()
+    more := first(pit, opt.Reverse)
+    // emit reports the pending write under the cursor and advances it.
+    emit := func() bool {
+        key, op := pit.Key()[len(scope):], pit.Value()
+        ok := op[0] == pendingDel || yield(copyBytes(key), copyBytes(op[1:]))
+        more = next(pit, opt.Reverse)
+        return ok
+    }
+    snapOpt := &RangeOptions{Reverse: opt.Reverse, KeysOnly: opt.KeysOnly}
+    err := iterate(tx.snap, scope, r, snapOpt, func(key []byte, value []byte) bool {
+        for more && before(pit.Key()[len(scope):], key) {
+            if !emit() {
+                return false
+            }
+        }
+        if more && bytes.Equal(pit.Key()[len(scope):], key) {
+            return emit()
+        }
+        read, _ := scopeKey(scope, key)
+        tx.reads[string(read)] = struct{}{}
+        return yield(key, value)
+    })
+    if err != nil || stopped {
+        return err
+    }
+    for more && emit() {
+    }
+    return pit.Error()
+}
+
+// writeKey checks that the transaction may write key and returns its full
+// key.
+func (tx *Tx) writeKey(scope, key []byte) ([]byte, error) {
+    if tx.closed {
+        return nil, ErrTxClosed
+    }
+    if !tx.writable {
+        return nil, ErrTxReadOnly
+    }
+    return scopeKey(scope, key)
+}
+
+func (tx *Tx) commit() error {
+    s := tx.s
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for key := range tx.reads {
+        if s.lastWrite[key] > tx.seq {
+            return ErrConflict
+        }
+    }
+    if tx.pending.Len() == 0 && len(tx.expires) == 0 {
+        return nil
+    }
+    b := new(writeBatch)
+    it := tx.pending.NewIterator(nil)
+    defer it.Release()
+    for it.Next() {
+        key, op := copyBytes(it.Key()), it.Value()
+        switch op[0] {
+        case pendingDel:
+            b.del(key)
+        case pendingPutKeepTTL:
+            b.putKeepTTL(key, op[1:])
+        default:
+            b.put(key, op[1:])
+        }
+    }
+    for key, at := range tx.expires {
+        if at.IsZero() {
+            b.persist([]byte(key))
+        } else {
+            b.expireAt([]byte(key), at)
+        }
+    }
+    return s.writeLocked(b)
+}
+
+func (tx *Tx) discard() {
+    if tx.closed {
+        return
+    }
+    tx.closed = true
+    tx.snap.Release()
+    if !tx.writable {
+        return
+    }
+    s := tx.s
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.txs, tx)
+    if len(s.txs) == 0 {
+        s.lastWrite = make(map[string]uint64)
+        return
+    }
+    if len(s.lastWrite) > lastWritePrune {
+        oldest := s.seq
+        for t := range s.txs {
+            if t.seq < oldest {
+                oldest = t.seq
+            }
+        }
+        for key, seq := range s.lastWrite {
+            if seq <= oldest {
+                delete(s.lastWrite, key)
+            }
+        }
+    }
+}
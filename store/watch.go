@@ -0,0 +1,168 @@
+package store
+
+import (
+    "bytes"
+    "github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+var (
+    ErrClosed        = errors.New("store: closed")
+    ErrWatchOverflow = errors.New("store: watcher fell behind")
+)
+
+const watchBuffer = 256
+
+type EventType byte
+
+const (
+    EventPut EventType = iota + 1
+    EventDelete
+    EventExpire // deleted by the reaper after its ttl ran out
+)
+
+func (t EventType) String() string {
+    switch t {
+    case EventPut:
+        return "put"
+    case EventDelete:
+        return "delete"
+    case EventExpire:
+        return "expire"
+    }
+    return "unknown"
+}
+
+// Event describes a committed write. Events of one commit share its Seq and
+// are delivered in commit order. Key and Value must not be modified.
+type Event struct {
+    Type  EventType
+    Key   []byte
+    Value []byte // new value of EventPut
+    Seq   uint64
+}
+
+type WatchOptions struct {
+    Buffer int         // events buffered for the consumer, 256 by default
+    Types  []EventType // deliver only events of these types, all when empty
+}
+
+// Watcher delivers the events of keys under a prefix on C.
+//
+// Writers never wait for watchers: when a consumer falls so far behind that
+// its buffer is full, the watcher is dropped, C is closed and Err returns
+// ErrWatchOverflow. The consumer is expected to resync and watch again.
+type Watcher struct {
+    C <-chan Event
+
+    s      *Store
+    c      chan Event
+    scope  []byte
+    prefix []byte // full key prefix
+    types  []EventType
+
+    // guarded by s.mu
+    stopped bool
+    err     error
+}
+
+func (s *Store) Watch(prefix []byte, opts ...*WatchOptions) *Watcher {
+    return s.watch(nil, prefix, opts)
+}
+
+func (s *Store) watch(scope, prefix []byte, opts []*WatchOptions) *Watcher {
+    size := watchBuffer
+    var types []EventType
+    if len(opts) > 0 && opts[0] != nil {
+        if opts[0].Buffer > 0 {
+            size = opts[0].Buffer
+        }
+        types = append(types, opts[0].Types...)
+    }
+    full := append(copyBytes(scope), prefix...)
+    c := make(chan Event, size)
+    w := &Watcher{C: c, s: s, c: c, scope: scope, prefix: full, types: types}
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    select {
+    case <-s.closeCh:
+        w.stop(ErrClosed)
+    default:
+        s.watchers[w] = struct{}{}
+    }
+    return w
+}
+
+// Close stops the watcher and closes C.
+func (w *Watcher) Close() {
+    w.s.mu.Lock()
+    defer w.s.mu.Unlock()
+    w.stop(nil)
+}
+
+// Err returns why the watcher stopped, nil while it runs or after Close.
+func (w *Watcher) Err() error {
+    w.s.mu.Lock()
+    defer w.s.mu.Unlock()
+    return w.err
+}
+
+// stop is called with s.mu held.
+func (w *Watcher) stop(err error) {
+    if w.stopped {
+        return
+    }
+    w.stopped = true
+    w.err = err
+    delete(w.s.watchers, w)
+    close(w.c)
+}
+
+func (w *Watcher) match(c change) bool {
+    if w.scope == nil && isSysKey(c.key) {
+        return false
+    }
+    if !bytes.HasPrefix(c.key, w.prefix) {
+        return false
+    }
+    if len(w.types) == 0 {
+        return true
+    }
+    for _, t := range w.types {
+        if t == c.typ {
+            return true
+        }
+    }
+    return false
+}
+
+// notify hands the changes of a commit to the watchers. It is called with
+// s.mu held, right after the commit.
+func (s *Store) notify(changes []change) {
+    if len(s.watchers) == 0 {
+        return
+    }
+    for _, c := range changes {
+        if c.typ == 0 {
+            continue
+        }
+        var ev *Event
+        for w := range s.watchers {
+            if !w.match(c) {
+                continue
+            }
+            if ev == nil {
+                ev = &Event{Type: c.typ, Key: copyBytes(c.key), Seq: s.seq}
+                if c.typ == EventPut {
+                    ev.Value = copyBytes(c.value)
+                }
+            }
+            e := *ev
+            e.Key = e.Key[len(w.scope):]
+            select {
+            case w.c <- e:
+            default:
+                w.stop(ErrWatchOverflow)
+            }
+        }
+    }
+}